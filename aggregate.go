@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Aggregate functions
+const (
+	aggCount = iota
+	aggSum
+	aggAvg
+	aggMin
+	aggMax
+)
+
+/*
+Aggregate is a partial aggregate over one FArr column
+Partials from different cells, cubes or workers are combined with Merge
+Min and Max are only meaningful when Count > 0
+*/
+type Aggregate struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+func (agg *Aggregate) Add(v float64) {
+	if agg.Count == 0 || v < agg.Min {
+		agg.Min = v
+	}
+	if agg.Count == 0 || v > agg.Max {
+		agg.Max = v
+	}
+	agg.Count++
+	agg.Sum += v
+}
+
+func (agg *Aggregate) Merge(other *Aggregate) {
+	if other.Count == 0 {
+		return
+	}
+	if agg.Count == 0 || other.Min < agg.Min {
+		agg.Min = other.Min
+	}
+	if agg.Count == 0 || other.Max > agg.Max {
+		agg.Max = other.Max
+	}
+	agg.Count += other.Count
+	agg.Sum += other.Sum
+}
+
+// The value of the aggregate function, NaN for avg, min and max of nothing
+func (agg *Aggregate) Result(aggFunc int) float64 {
+	switch aggFunc {
+	case aggCount:
+		return float64(agg.Count)
+	case aggSum:
+		return agg.Sum
+	}
+	if agg.Count == 0 {
+		return math.NaN()
+	}
+	switch aggFunc {
+	case aggAvg:
+		return agg.Sum / float64(agg.Count)
+	case aggMin:
+		return agg.Min
+	case aggMax:
+		return agg.Max
+	}
+	return math.NaN()
+}
+
+// Find all leaf nodes that may overlap the region of the query (polygon or range)
+// Retrun the indices of node
+func (dTree *DTree) RegionSearch(query *Query) ([]int, error) {
+	if query.Polygon == nil {
+		return dTree.PredicateSearch(query.ToPredicate())
+	}
+	cubeInds, err := dTree.PolygonSearch(query.Polygon, query.QueryDims[0], query.QueryDims[1])
+	if err != nil || query.Predicate == nil {
+		return cubeInds, err
+	}
+	finalNodeList := make([]int, 0)
+	for _, cubeInd := range cubeInds {
+		node := &dTree.Nodes[cubeInd]
+		if query.Predicate.BoxCheck(node.Dims, node.Mins, node.Maxs) != boxOutside {
+			finalNodeList = append(finalNodeList, cubeInd)
+		}
+	}
+	return finalNodeList, nil
+}
+
+/*
+Split the cells of the node overlapping the query region into the cells fully
+inside the region and the cells partially inside it
+*/
+func (node *DTreeNode) RegionCells(query *Query) ([]int, []int) {
+	boxMins := make([]float64, len(node.Dims))
+	boxMaxs := make([]float64, len(node.Dims))
+	for i := range boxMins {
+		boxMins[i], boxMaxs[i] = math.Inf(-1), math.Inf(1)
+	}
+	if query.Polygon != nil {
+		xInd, yInd, err := polygonDimInds(node.Dims, query.QueryDims[0], query.QueryDims[1])
+		if err != nil {
+			return nil, nil
+		}
+		boxMins[xInd], boxMins[yInd], boxMaxs[xInd], boxMaxs[yInd] = query.Polygon.Bounds()
+	}
+	lo, hi, overlap := node.GridRange(boxMins, boxMaxs)
+	if !overlap {
+		return nil, nil
+	}
+	var insideInds, partialInds []int
+	for _, metaInd := range node.MetaIndsInGridRange(lo, hi) {
+		cellMins, cellMaxs, _ := node.Boundary(metaInd)
+		switch query.RegionBoxCheck(node.Dims, cellMins, cellMaxs) {
+		case boxInside:
+			insideInds = append(insideInds, metaInd)
+		case boxPartial:
+			partialInds = append(partialInds, metaInd)
+		}
+	}
+	return insideInds, partialInds
+}
+
+// Grouping of aggregate queries
+const (
+	groupNone = iota
+	groupLeaf
+	groupGrid
+)
+
+// Partial aggregates keyed by group: the leaf node index, or the pixel index in the grid
+type GroupedAggregate struct {
+	Groups map[int]*Aggregate
+}
+
+func InitGroupedAggregate() *GroupedAggregate {
+	return &GroupedAggregate{Groups: make(map[int]*Aggregate)}
+}
+
+func (grouped *GroupedAggregate) group(key int) *Aggregate {
+	agg, exists := grouped.Groups[key]
+	if !exists {
+		agg = new(Aggregate)
+		grouped.Groups[key] = agg
+	}
+	return agg
+}
+
+func (grouped *GroupedAggregate) Merge(other *GroupedAggregate) {
+	for key, agg := range other.Groups {
+		grouped.group(key).Merge(agg)
+	}
+}
+
+/*
+Compute the aggregate of query.AggDim over the query region, on the cubes owned by this worker
+Cells fully inside the region are answered by CubeCell.Count for count, and by
+the per-cell aggregates when the cube maintains AggDim, only the other cells are decoded
+*/
+func (worker *Worker) AggregateQuery(query *Query) (*Aggregate, error) {
+	grouped, err := worker.GroupedAggregateQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return grouped.group(0), nil
+}
+
+/*
+Compute the aggregates of query.AggDim over the query region grouped by query.GroupBy,
+on the cubes owned by this worker
+With grid grouping a cell is answered as a whole only when it lies in a single pixel
+*/
+func (worker *Worker) GroupedAggregateQuery(query *Query) (*GroupedAggregate, error) {
+	if query.AggFunc < aggCount || query.AggFunc > aggMax {
+		err := errors.New(fmt.Sprintf("Unknown aggregate function %d", query.AggFunc))
+		fmt.Println(err)
+		return nil, err
+	}
+	if err := query.ValidateRegion(); err != nil {
+		return nil, err
+	}
+	if err := query.ValidateGroupBy(); err != nil {
+		return nil, err
+	}
+	cubeInds, err := worker.dTree.RegionSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	grouped := InitGroupedAggregate()
+	for _, cubeInd := range cubeInds {
+		if worker.cubeList[cubeInd] != worker.id {
+			// partial of another worker
+			continue
+		}
+		node := &worker.dTree.Nodes[cubeInd]
+		insideInds, partialInds := node.RegionCells(query)
+		xInd, yInd, gridErr := -1, -1, error(nil)
+		if query.GroupBy == groupGrid {
+			xInd, yInd, gridErr = polygonDimInds(node.Dims, query.GroupDims[0], query.GroupDims[1])
+		}
+		// group of a whole cell, false when the cell has to be grouped by point
+		cellGroup := func(metaInd int) (int, bool) {
+			switch query.GroupBy {
+			case groupNone:
+				return 0, true
+			case groupLeaf:
+				return cubeInd, true
+			}
+			if gridErr != nil {
+				return -1, false
+			}
+			cellMins, cellMaxs, _ := node.Boundary(metaInd)
+			return query.Heatmap.BoxPixelInd(cellMins[xInd], cellMins[yInd], cellMaxs[xInd], cellMaxs[yInd])
+		}
+		for _, metaInd := range insideInds {
+			key, whole := cellGroup(metaInd)
+			if !whole {
+				partialInds = append(partialInds, metaInd)
+			} else if query.AggFunc == aggCount {
+				if count := worker.db.CellCount(cubeInd, metaInd); count > 0 {
+					grouped.group(key).Count += count
+				}
+			} else if cellAgg := worker.db.CellAggregate(cubeInd, metaInd, query.AggDim); cellAgg != nil {
+				if cellAgg.Count > 0 {
+					grouped.group(key).Merge(cellAgg)
+				}
+			} else {
+				partialInds = append(partialInds, metaInd)
+			}
+		}
+		if len(partialInds) == 0 {
+			continue
+		}
+		for _, dp := range worker.db.ReadBatch(cubeInd, partialInds) {
+			if !query.CheckRegion(&dp) {
+				continue
+			}
+			key := 0
+			switch query.GroupBy {
+			case groupLeaf:
+				key = cubeInd
+			case groupGrid:
+				pixel, in := query.Heatmap.PixelInd(dp.getFloatValByDim(query.GroupDims[0]), dp.getFloatValByDim(query.GroupDims[1]))
+				if !in {
+					continue
+				}
+				key = pixel
+			}
+			grouped.group(key).Add(dp.getFloatValByDim(query.AggDim))
+		}
+	}
+	return grouped, nil
+}
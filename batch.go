@@ -0,0 +1,149 @@
+package main
+
+// Result of one query of a batch, tagged by the query ID
+type BatchResult struct {
+	QueryID int
+	Points  []DataPoint
+	Error   string `json:",omitempty"`
+}
+
+// The reads of a cube shared by the equality and range queries of a batch
+type batchCube struct {
+	// some query scans the whole cube, or every query reads its cells one by one
+	scan   bool
+	single bool
+	// union of the cells read, and of the dims decoded, nil for every dim
+	metaInds []int
+	dims     []uint
+	allDims  bool
+	// positions in the batch of the queries on the cube, and their plans of the cube
+	queries []int
+	leaves  []PlanLeaf
+}
+
+// Add the plan of the query at pos to the reads of the cube
+func (cube *batchCube) add(pos int, leaf PlanLeaf, dims []uint) {
+	if len(cube.queries) == 0 {
+		cube.single = true
+	}
+	cube.queries = append(cube.queries, pos)
+	cube.leaves = append(cube.leaves, leaf)
+	cube.scan = cube.scan || leaf.Read == readAll
+	cube.single = cube.single && leaf.Read == readSingle
+	cube.metaInds = append(cube.metaInds, leaf.MetaInds...)
+	cube.allDims = cube.allDims || dims == nil
+	cube.dims = append(cube.dims, dims...)
+}
+
+/*
+Execute a batch of queries and return their results in the batch order
+The equality and range queries are grouped by cube: each cube is loaded once, and each cell
+overlapping any of them decoded once, with the union of their columns. A cube some query
+would scan whole is scanned once for all of them. Other query types run one by one
+*/
+func (worker *Worker) BatchQuery(queries []*Query) []BatchResult {
+	results := make([]BatchResult, len(queries))
+	cubes := make(map[int]*batchCube)
+	var cubeOrder []int
+	for pos, query := range queries {
+		results[pos].QueryID = query.ID
+		if query.QueryType != 0 && query.QueryType != 1 {
+			dPoints, err := worker.executeCached(query)
+			if err != nil {
+				results[pos].Error = err.Error()
+			}
+			results[pos].Points = dPoints
+			continue
+		}
+		leaves, err := worker.planLeaves(query)
+		if err != nil {
+			results[pos].Error = err.Error()
+			continue
+		}
+		for _, leaf := range leaves {
+			cube, exists := cubes[leaf.CubeInd]
+			if !exists {
+				cube = new(batchCube)
+				cubes[leaf.CubeInd] = cube
+				cubeOrder = append(cubeOrder, leaf.CubeInd)
+			}
+			cube.add(pos, leaf, query.decodeDims())
+		}
+	}
+
+	for _, cubeInd := range cubeOrder {
+		cube := cubes[cubeInd]
+		dims := cube.dims
+		if cube.allDims {
+			dims = nil
+		}
+		if cube.scan {
+			// every query checks every point, a superset of its cells
+			dPoints := worker.getAll([]int{cubeInd}, dims)
+			for _, pos := range cube.queries {
+				results[pos].Points = appendMatches(results[pos].Points, queries[pos], dPoints)
+			}
+			continue
+		}
+		cellPoints := make(map[int][]DataPoint)
+		for _, metaInd := range cube.metaInds {
+			if _, exists := cellPoints[metaInd]; exists {
+				continue
+			}
+			if cube.single {
+				cellPoints[metaInd] = worker.db.ReadSingleColumns(cubeInd, metaInd, dims)
+			} else {
+				cellPoints[metaInd] = worker.db.ReadBatchColumns(cubeInd, []int{metaInd}, dims)
+			}
+		}
+		for i, pos := range cube.queries {
+			for _, metaInd := range cube.leaves[i].MetaInds {
+				results[pos].Points = appendMatches(results[pos].Points, queries[pos], cellPoints[metaInd])
+			}
+		}
+	}
+	for pos, query := range queries {
+		if query.Limit > 0 && len(results[pos].Points) > query.Limit {
+			results[pos].Points = results[pos].Points[:query.Limit]
+		}
+	}
+	return results
+}
+
+// Plans of the leaves of an equality or range query that have points to read
+func (worker *Worker) planLeaves(query *Query) ([]PlanLeaf, error) {
+	cubeInds, _, err := worker.searchLeaves(query)
+	if err != nil {
+		return nil, err
+	}
+	var leaves []PlanLeaf
+	for _, cubeInd := range cubeInds {
+		leaf, err := worker.planLeaf(query, cubeInd)
+		if err != nil {
+			return nil, err
+		}
+		if leaf.Read != readNone {
+			leaves = append(leaves, leaf)
+		}
+	}
+	return leaves, nil
+}
+
+// Append the projection of the points satisfying the query
+func appendMatches(dataPoints []DataPoint, query *Query, dPoints []DataPoint) []DataPoint {
+	for _, dp := range dPoints {
+		if query.CheckPoint(&dp) {
+			dataPoints = append(dataPoints, query.Project(&dp))
+		}
+	}
+	return dataPoints
+}
+
+// Whether the query runs whole on the worker findWorker routes it to, and so can be batched
+func (query *Query) batchable() bool {
+	switch query.QueryType {
+	case 0, 1, 2, 3, 4, 9:
+		return query.PageSize == 0 && query.Explain == explainNone && query.Epsilon == 0 && query.MaxCells == 0
+	}
+	return false
+}
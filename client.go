@@ -3,11 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -30,11 +33,28 @@ type ClientInfo struct {
 type Client struct {
 	workerList     map[int]WorkerInfo
 	treeMetadata   *DTree
+	joinTree       *DTree              // dataset joined by QueryType = 11, nil until sent
 	leafMap        map[int][]DataBatch //key is worker number
 	cubeList       map[int]int         //key: cube val: worker
 	clientListener net.Listener
 	msgChan        chan []byte
 	start          time.Time
+	queryCount     int
+	pendingAggs    map[int]*pendingAggregate //key: query id
+	aggLock        sync.Mutex
+}
+
+// Partial aggregates, heatmaps, OD trips, flow counts, top-N or joins of a query received from workers so far
+type pendingAggregate struct {
+	query     *Query
+	agg       Aggregate
+	grouped   *GroupedAggregate
+	heatmap   *Heatmap
+	trips     []DataPoint
+	flow      *ODFlow
+	top       *TopN
+	join      *JoinResult
+	remaining int
 }
 
 //InitClient ...
@@ -66,6 +86,7 @@ func InitClient() (client *Client, err error) {
 		treeMetadata:   dTree,
 		leafMap:        make(map[int][]DataBatch, workerNumber),
 		cubeList:       make(map[int]int),
+		pendingAggs:    make(map[int]*pendingAggregate),
 		msgChan:        make(chan []byte),
 		clientListener: clientConn,
 	}
@@ -148,6 +169,28 @@ func (cl *Client) Execute(qs []*Query) (err error) {
 	return nil
 }
 
+// Address the client listens on for results, empty when it is not listening
+func (cl *Client) address() string {
+	if cl.clientListener == nil {
+		return ""
+	}
+	return cl.clientListener.Addr().String()
+}
+
+// ExecuteText parses statements of the query language against the import schema and executes them
+func (cl *Client) ExecuteText(statements []string) (err error) {
+	schema := ImportSchema()
+	var qs []*Query
+	for _, text := range statements {
+		q, err := ParseQuery(text, schema, cl.address())
+		if err != nil {
+			return err
+		}
+		qs = append(qs, q)
+	}
+	return cl.Execute(qs)
+}
+
 func (cl *Client) Sync() (err error) {
 
 	tree := MarshalTree(cl.treeMetadata)
@@ -187,12 +230,36 @@ func (cl *Client) Sync() (err error) {
 	return nil
 }
 
+/*
+SendJoinDataset builds the tree of a second dataset, e.g. subway entrances, on dTree and sends
+it whole to every worker, where QueryType = 11 joins it with the points of their leaves
+*/
+func (cl *Client) SendJoinDataset(dTree *DTree, points []DataPoint) error {
+	if err := dTree.UpdateTree(points); err != nil {
+		return err
+	}
+	cl.joinTree = dTree
+	treeMsg := Message{Type: "JoinTree", MsgBytes: MarshalTree(dTree)}
+	batches := dTree.ToDataBatch()
+	for workerid := range cl.workerList {
+		if err := cl.sendMessage(workerid, treeMsg); err != nil {
+			continue
+		}
+		for _, batch := range batches {
+			b, _ := json.Marshal(&batch)
+			cl.sendMessage(workerid, Message{Type: "JoinDataBatch", MsgBytes: b})
+		}
+	}
+	log.Println("Join dataset sent...")
+	return nil
+}
+
 func (cl *Client) findWorker(q *Query) int {
 	if q.QueryType == 0 {
 		cubeInds, _ := cl.treeMetadata.EquatlitySearch(q.QueryDims, q.QueryDimVals)
 		//log.Println(cubeInds)
 		return cl.cubeList[cubeInds[0]]
-	} else if q.QueryType == 1 {
+	} else if q.QueryType == 1 || q.QueryType == 3 || q.QueryType == 4 || q.QueryType == 9 {
 		return 2
 	} else {
 		return 0
@@ -201,11 +268,69 @@ func (cl *Client) findWorker(q *Query) int {
 
 //TODO:
 func (cl *Client) executeQuery(q *Query) (err error) {
+	cl.queryCount++
+	q.ID = cl.queryCount
+	if q.QueryType == 5 || q.QueryType == 6 || q.QueryType == 7 || q.QueryType == 8 || q.QueryType == 10 || q.QueryType == 11 {
+		return cl.executeAggregate(q)
+	}
+	if (q.QueryType == 1 || q.QueryType == 4) && q.PageSize > 0 {
+		return cl.FetchPage(q, q.Cursor)
+	}
 	//TODO: TreeSearch to find which worker to route query to
 	workerid := cl.findWorker(q)
 	//send query to worker
+	return cl.sendQuery(workerid, q)
+}
+
+/*
+ExecuteBatch sends the queries routed to the same worker in one request, their results come
+back tagged by query ID in one response per worker
+Aggregates, pages, plans and approximate KNN have their own routing and are executed one by one
+*/
+func (cl *Client) ExecuteBatch(qs []*Query) (err error) {
+	batches := make(map[int][]*Query)
+	var workerIDs []int
+	for _, q := range qs {
+		if !q.batchable() {
+			if err := cl.executeQuery(q); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		cl.queryCount++
+		q.ID = cl.queryCount
+		workerid := cl.findWorker(q)
+		if _, exists := batches[workerid]; !exists {
+			workerIDs = append(workerIDs, workerid)
+		}
+		batches[workerid] = append(batches[workerid], q)
+	}
+	for _, workerid := range workerIDs {
+		b, _ := json.Marshal(batches[workerid])
+		if err := cl.sendMessage(workerid, Message{Type: "QueryBatch", MsgBytes: b}); err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+// CacheStats asks every worker for the statistics of its result cache, logged in HandleTCPConn
+func (cl *Client) CacheStats() (err error) {
+	for _, w := range cl.workerList {
+		if err := cl.sendMessage(w.id, Message{Type: "CacheStats"}); err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+func (cl *Client) sendQuery(workerid int, q *Query) error {
 	query := MarshalQuery(q)
-	qmsg, _ := json.Marshal(Message{Type: "Query", MsgBytes: query})
+	return cl.sendMessage(workerid, Message{Type: "Query", MsgBytes: query})
+}
+
+func (cl *Client) sendMessage(workerid int, msg Message) error {
+	qmsg, _ := json.Marshal(msg)
 	dest := cl.workerList[workerid]
 	conn, err := net.Dial("tcp", dest.address.String())
 	if err != nil {
@@ -221,6 +346,199 @@ func (cl *Client) executeQuery(q *Query) (err error) {
 	return nil
 }
 
+/*
+Request the page of a paginated query starting at cursor, empty for the first page
+The page is sent to the worker owning the leaf of the cursor, the cursor of the
+next page is logged in HandleTCPConn
+*/
+func (cl *Client) FetchPage(q *Query, cursor string) error {
+	c, err := DecodeCursor(cursor)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		if err := q.ValidateRegion(); err != nil {
+			return err
+		}
+		cubeInds, err := cl.treeMetadata.RegionSearch(q)
+		if err != nil {
+			return err
+		}
+		if len(cubeInds) == 0 {
+			log.Println("No results found")
+			return nil
+		}
+		sort.Ints(cubeInds)
+		c = &Cursor{CubeInd: cubeInds[0]}
+	}
+	q.Cursor = cursor
+	return cl.sendQuery(cl.cubeList[c.CubeInd], q)
+}
+
+// Send the aggregate, heatmap, OD, top-N or join query to every worker holding cubes in its region,
+// the partial results are merged in HandleTCPConn
+func (cl *Client) executeAggregate(q *Query) error {
+	var cubeInds []int
+	var err error
+	if q.QueryType == 5 {
+		if err = q.ValidateGroupBy(); err == nil {
+			err = q.ValidateRegion()
+		}
+		if err == nil {
+			cubeInds, err = cl.treeMetadata.RegionSearch(q)
+		}
+	} else if q.QueryType == 10 {
+		if err = q.ValidateTopN(); err == nil {
+			cubeInds, err = cl.treeMetadata.RegionSearch(q)
+		}
+	} else if q.QueryType == 6 {
+		if err = q.ValidateHeatmap(); err == nil {
+			cubeInds, err = cl.treeMetadata.PredicateSearch(q.heatmapPredicate())
+		}
+	} else if q.QueryType == 11 {
+		var join *SpatialJoin
+		if cl.joinTree == nil {
+			err = errors.New("No dataset to join, load one with SendJoinDataset")
+			fmt.Println(err)
+		} else if join, err = q.SpatialJoin(); err == nil {
+			// the leaves within the radius of some leaf of the joined dataset
+			join.walk(cl.treeMetadata, cl.joinTree, func(leftInd int, rightInd int) {
+				cubeInds = append(cubeInds, leftInd)
+			})
+		}
+	} else {
+		if err = q.ValidateOD(); err == nil {
+			cubeInds, err = cl.treeMetadata.PredicateSearch(q.odPredicate())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	workers := make(map[int]bool)
+	for _, cubeInd := range cubeInds {
+		workers[cl.cubeList[cubeInd]] = true
+	}
+	pending := &pendingAggregate{query: q, remaining: len(workers)}
+	if q.QueryType == 6 {
+		pending.heatmap = q.Heatmap.emptyCopy()
+	} else if q.QueryType == 8 {
+		pending.flow = InitODFlow(len(q.Origins), len(q.Destinations))
+	} else if q.QueryType == 10 {
+		pending.top = new(TopN)
+	} else if q.QueryType == 11 {
+		pending.join = new(JoinResult)
+	} else if q.GroupBy != groupNone {
+		pending.grouped = InitGroupedAggregate()
+	}
+	if len(workers) == 0 {
+		pending.log()
+		return nil
+	}
+	cl.aggLock.Lock()
+	cl.pendingAggs[q.ID] = pending
+	cl.aggLock.Unlock()
+	for workerid := range workers {
+		if err := cl.sendQuery(workerid, q); err != nil {
+			// the worker will never answer
+			cl.mergeAggregate(q.ID, nil)
+		}
+	}
+	return nil
+}
+
+// Merge a partial result of a worker into its query, nil when the worker failed
+// The result is logged once all the workers have answered
+func (cl *Client) mergeAggregate(queryID int, msgBytes []byte) {
+	cl.aggLock.Lock()
+	defer cl.aggLock.Unlock()
+	pending, exists := cl.pendingAggs[queryID]
+	if !exists {
+		return
+	}
+	if msgBytes != nil {
+		if pending.query.QueryType == 7 {
+			var trips []DataPoint
+			if err := json.Unmarshal(msgBytes, &trips); err == nil {
+				pending.trips = append(pending.trips, trips...)
+			}
+		} else if pending.heatmap != nil {
+			hm := new(Heatmap)
+			if err := json.Unmarshal(msgBytes, hm); err == nil {
+				pending.heatmap.Merge(hm)
+			}
+		} else if pending.flow != nil {
+			flow := new(ODFlow)
+			if err := json.Unmarshal(msgBytes, flow); err == nil {
+				pending.flow.Merge(flow)
+			}
+		} else if pending.join != nil {
+			join := new(JoinResult)
+			if err := json.Unmarshal(msgBytes, join); err == nil {
+				pending.join.Merge(join)
+			}
+		} else if pending.top != nil {
+			top := new(TopN)
+			if err := json.Unmarshal(msgBytes, top); err == nil {
+				pending.top.Merge(top, pending.query.K, pending.query.Descending)
+			}
+		} else if pending.grouped != nil {
+			grouped := InitGroupedAggregate()
+			if err := json.Unmarshal(msgBytes, grouped); err == nil {
+				pending.grouped.Merge(grouped)
+			}
+		} else {
+			agg := new(Aggregate)
+			if err := json.Unmarshal(msgBytes, agg); err == nil {
+				pending.agg.Merge(agg)
+			}
+		}
+	}
+	pending.remaining--
+	if pending.remaining > 0 {
+		return
+	}
+	delete(cl.pendingAggs, queryID)
+	pending.log()
+}
+
+func (pending *pendingAggregate) log() {
+	if pending.query.QueryType == 7 {
+		log.Printf("Trips of query %d: %v\n", pending.query.ID, pending.trips)
+		return
+	}
+	if pending.heatmap != nil {
+		log.Printf("Heatmap of query %d: %v\n", pending.query.ID, pending.heatmap.Values)
+		return
+	}
+	if pending.flow != nil {
+		log.Printf("Flow counts of query %d: %v\n", pending.query.ID, pending.flow.Counts)
+		return
+	}
+	if pending.join != nil && pending.query.JoinCount {
+		for _, jc := range pending.join.Counts {
+			log.Printf("Join of query %d: %d points within %v of %v\n", pending.query.ID, jc.Count, pending.query.Radius, jc.Right.getFloatValsByDims(pending.query.JoinDims))
+		}
+		return
+	}
+	if pending.join != nil {
+		log.Printf("Join of query %d: %d pairs\n", pending.query.ID, pending.join.PairNum)
+		return
+	}
+	if pending.top != nil {
+		log.Printf("Top %d of query %d: %v %v\n", pending.query.K, pending.query.ID, pending.top.Values, pending.top.Points)
+		return
+	}
+	if pending.grouped != nil {
+		results := make(map[int]float64, len(pending.grouped.Groups))
+		for key, agg := range pending.grouped.Groups {
+			results[key] = agg.Result(pending.query.AggFunc)
+		}
+		log.Printf("Aggregate of query %d by group: %v\n", pending.query.ID, results)
+		return
+	}
+	log.Printf("Aggregate of query %d over %d points: %v\n", pending.query.ID, pending.agg.Count, pending.agg.Result(pending.query.AggFunc))
+}
+
 func (cl *Client) TCPListener() {
 	for {
 		c, err := cl.clientListener.Accept()
@@ -244,16 +562,63 @@ func (cl *Client) HandleTCPConn(c net.Conn) {
 	err = json.Unmarshal(buf.Bytes(), &msg)
 	if msg.Type == "Error" {
 		log.Println("Error when executing query")
+		cl.mergeAggregate(msg.QueryID, nil)
+	}
+	if msg.Type == "Aggregate" {
+		cl.mergeAggregate(msg.QueryID, msg.MsgBytes)
+		return
+	}
+	if msg.Type == "JoinPairs" {
+		// a batch of a join still running, its number of pairs comes with the Aggregate of the worker
+		var pairs []JoinPair
+		json.Unmarshal(msg.MsgBytes, &pairs)
+		log.Printf("Join of query %d: %d pairs from worker %d %v\n", msg.QueryID, len(pairs), msg.SenderID, pairs)
+		return
+	}
+	if msg.Type == "BatchResults" {
+		var results []BatchResult
+		json.Unmarshal(msg.MsgBytes, &results)
+		for _, result := range results {
+			if result.Error != "" {
+				log.Printf("Error when executing query %d: %s\n", result.QueryID, result.Error)
+				continue
+			}
+			log.Printf("Results of query %d from worker %d\n", result.QueryID, msg.SenderID)
+			log.Println(result.Points)
+		}
+		return
+	}
+	if msg.Type == "CacheStats" {
+		var stats CacheStats
+		json.Unmarshal(msg.MsgBytes, &stats)
+		log.Printf("Result cache of worker %d: %+v\n", msg.SenderID, stats)
+		return
+	}
+	if msg.Type == "Plan" {
+		plan := new(Plan)
+		json.Unmarshal(msg.MsgBytes, plan)
+		log.Printf("Plan of query %d from worker %d\n%s", msg.QueryID, msg.SenderID, plan)
+		return
 	}
 
 	//convert to DataPoints
 	var b []DataPoint
 	json.Unmarshal(msg.MsgBytes, &b)
 	log.Println(b)
+	if msg.Type == "Page" && msg.Cursor != "" {
+		log.Printf("Page of query %d, resume with FetchPage and cursor %s\n", msg.QueryID, msg.Cursor)
+	} else if msg.Type == "Page" {
+		log.Printf("Last page of query %d\n", msg.QueryID)
+	}
+	if msg.ErrorBound > 0 {
+		log.Printf("Approximate result of query %d, within a factor %f of the exact distances\n", msg.QueryID, 1+msg.ErrorBound)
+	} else if msg.ErrorBound < 0 {
+		log.Printf("Approximate result of query %d, without an error bound\n", msg.QueryID)
+	}
 	// log.Println("Received results")
 	// elapsed := time.Since(cl.start)
 	// log.Printf("Total time used in executing queries: %dns \n ", elapsed.Nanoseconds)
-	if len(b) == 0 {
+	if len(b) == 0 && msg.Cursor == "" {
 		log.Println("No results found")
 	}
 
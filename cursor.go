@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+/*
+Cursor is the position of a paginated range or polygon query: the next point to scan is
+the Offset-th point, in storage order, of the cell MetaInd of the leaf CubeInd
+Leaves are scanned by increasing index and their cells by increasing meta index,
+points are appended at the tail of a cell, so a cursor stays valid while data is fed
+*/
+type Cursor struct {
+	CubeInd int
+	MetaInd int
+	Offset  int
+}
+
+// Opaque string form of the cursor, passed back by the client to resume
+func (cursor *Cursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d.%d", cursor.CubeInd, cursor.MetaInd, cursor.Offset)))
+}
+
+// Decode a cursor from Encode, nil for the empty string which starts from the beginning
+func DecodeCursor(s string) (*Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	cursor := new(Cursor)
+	if err == nil {
+		_, err = fmt.Sscanf(string(b), "%d.%d.%d", &cursor.CubeInd, &cursor.MetaInd, &cursor.Offset)
+	}
+	if err != nil || cursor.CubeInd < 0 || cursor.MetaInd < 0 || cursor.Offset < 0 {
+		err := errors.New(fmt.Sprintf("Invalid cursor %q", s))
+		return nil, err
+	}
+	return cursor, nil
+}
+
+/*
+ResultIterator streams the points of a range or polygon query cell by cell,
+on the leaves owned by the worker, it stops at the first leaf owned by another
+worker and Cursor then points to that leaf
+*/
+type ResultIterator struct {
+	worker   *Worker
+	query    *Query
+	cubeInds []int
+	cubePos  int
+	// cells of the current leaf overlapping the region, and whether each needs a point check
+	metaInds []int
+	partial  []bool
+	metaPos  int
+	// dims decoded for the query, nil for every dim
+	decodeDims []uint
+	// points of the current cell, nil until read
+	points []DataPoint
+	offset int
+}
+
+// Start streaming the query from the cursor, nil cursor for the beginning
+func (worker *Worker) RegionIterator(query *Query, cursor *Cursor) (*ResultIterator, error) {
+	if err := query.ValidateRegion(); err != nil {
+		return nil, err
+	}
+	cubeInds, err := worker.dTree.RegionSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(cubeInds)
+	it := &ResultIterator{worker: worker, query: query, cubeInds: cubeInds, decodeDims: query.decodeDims()}
+	if cursor == nil {
+		it.enterCube(0, 0, 0)
+		return it, nil
+	}
+	if cursor.CubeInd >= len(worker.dTree.Nodes) || !worker.dTree.Nodes[cursor.CubeInd].IsLeaf {
+		// the leaf was split, its points are now spread over the new leaves
+		err := errors.New(fmt.Sprintf("Cursor refers to node %d which is no longer a leaf", cursor.CubeInd))
+		return nil, err
+	}
+	it.enterCube(sort.SearchInts(cubeInds, cursor.CubeInd), cursor.MetaInd, cursor.Offset)
+	return it, nil
+}
+
+func (it *ResultIterator) owned() bool {
+	return it.cubePos < len(it.cubeInds) && it.worker.cubeList[it.cubeInds[it.cubePos]] == it.worker.id
+}
+
+// Move to the leaf at cubePos, resuming at the given cell and offset when the leaf is the one of the cursor
+func (it *ResultIterator) enterCube(cubePos int, metaInd int, offset int) {
+	it.cubePos = cubePos
+	it.metaInds, it.partial = nil, nil
+	it.metaPos, it.points, it.offset = 0, nil, 0
+	if !it.owned() {
+		return
+	}
+	insideInds, partialInds := it.worker.dTree.Nodes[it.cubeInds[cubePos]].RegionCells(it.query)
+	isPartial := make(map[int]bool)
+	for _, metaInd := range partialInds {
+		isPartial[metaInd] = true
+	}
+	it.metaInds = append(insideInds, partialInds...)
+	sort.Ints(it.metaInds)
+	for _, metaInd := range it.metaInds {
+		it.partial = append(it.partial, isPartial[metaInd])
+	}
+	it.metaPos = sort.SearchInts(it.metaInds, metaInd)
+	if it.metaPos < len(it.metaInds) && it.metaInds[it.metaPos] == metaInd {
+		it.offset = offset
+	}
+}
+
+// Next point of the query, false when the owned leaves are exhausted
+func (it *ResultIterator) Next() (DataPoint, bool) {
+	for it.owned() {
+		if it.metaPos >= len(it.metaInds) {
+			it.enterCube(it.cubePos+1, 0, 0)
+			continue
+		}
+		cubeInd := it.cubeInds[it.cubePos]
+		if it.points == nil {
+			//Perform readBatch to force using cache, since ReadSingle doesn't cache metaCube
+			it.points = it.worker.db.ReadBatchColumns(cubeInd, []int{it.metaInds[it.metaPos]}, it.decodeDims)
+		}
+		if it.offset >= len(it.points) {
+			it.metaPos++
+			it.points, it.offset = nil, 0
+			continue
+		}
+		dp := it.points[it.offset]
+		it.offset++
+		if it.partial[it.metaPos] && !it.query.CheckRegion(&dp) {
+			continue
+		}
+		return it.query.Project(&dp), true
+	}
+	return DataPoint{}, false
+}
+
+// Cursor of the next point to scan, nil when the query is exhausted on every worker
+func (it *ResultIterator) Cursor() *Cursor {
+	if it.cubePos >= len(it.cubeInds) {
+		return nil
+	}
+	cursor := &Cursor{CubeInd: it.cubeInds[it.cubePos]}
+	if it.metaPos < len(it.metaInds) {
+		cursor.MetaInd = it.metaInds[it.metaPos]
+		cursor.Offset = it.offset
+	}
+	return cursor
+}
+
+/*
+Return the next page of at most query.PageSize points from query.Cursor, and the cursor
+of the following page, empty when there is none
+A page ends early at a leaf owned by another worker, the cursor then routes to its owner
+*/
+func (worker *Worker) RegionPage(query *Query) ([]DataPoint, string, error) {
+	if query.PageSize <= 0 {
+		err := errors.New(fmt.Sprintf("Page size %d is not positive", query.PageSize))
+		return nil, "", err
+	}
+	cursor, err := DecodeCursor(query.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	it, err := worker.RegionIterator(query, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	dataPoints := make([]DataPoint, 0, query.PageSize)
+	for {
+		next := it.Cursor()
+		dp, ok := it.Next()
+		if !ok {
+			next = it.Cursor()
+		} else if len(dataPoints) < query.PageSize {
+			dataPoints = append(dataPoints, dp)
+			continue
+		}
+		// the page is full with dp left for the next one, or the owned leaves are exhausted
+		if next == nil {
+			return dataPoints, "", nil
+		}
+		return dataPoints, next.Encode(), nil
+	}
+}
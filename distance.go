@@ -0,0 +1,348 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// Mean earth radius in metres
+	earthRadius = 6371008.8
+)
+
+// DistanceMetric measures the distance between values aligned with the same dims
+type DistanceMetric interface {
+	Distance(p1 []float64, p2 []float64) float64
+	// Lower bound of the distance from center to any point in the box [mins, maxs]
+	// Used by KNN as the priority of boundary points, so it must never overestimate
+	LowerBound(center []float64, mins []float64, maxs []float64) float64
+	// Upper bound of the distance from center to any point in the box [mins, maxs]
+	UpperBound(center []float64, mins []float64, maxs []float64) float64
+	// Lower bound of the distance between any two points of the boxes [mins1, maxs1] and [mins2, maxs2]
+	BoxLowerBound(mins1 []float64, maxs1 []float64, mins2 []float64, maxs2 []float64) float64
+	// Box enclosing every point within radius of center
+	BoundingBox(center []float64, radius float64) ([]float64, []float64)
+}
+
+// gap between v and the range [min, max], 0 when v is inside
+func rangeGap(v, min, max float64) float64 {
+	if v < min {
+		return min - v
+	} else if v > max {
+		return v - max
+	}
+	return 0
+}
+
+// largest distance between v and a value of the range [min, max]
+func rangeSpread(v, min, max float64) float64 {
+	return math.Max(math.Abs(v-min), math.Abs(v-max))
+}
+
+// gap between the ranges [min1, max1] and [min2, max2], 0 when they overlap
+func boxGap(min1, max1, min2, max2 float64) float64 {
+	return math.Max(0, math.Max(min2-max1, min1-max2))
+}
+
+// Box of center +- halfWidths
+func centeredBox(center []float64, halfWidths []float64) ([]float64, []float64) {
+	mins := make([]float64, len(center))
+	maxs := make([]float64, len(center))
+	for i, v := range center {
+		mins[i] = v - halfWidths[i]
+		maxs[i] = v + halfWidths[i]
+	}
+	return mins, maxs
+}
+
+func uniformWidths(n int, width float64) []float64 {
+	halfWidths := make([]float64, n)
+	for i := range halfWidths {
+		halfWidths[i] = width
+	}
+	return halfWidths
+}
+
+type EuclideanMetric struct {
+}
+
+func (m *EuclideanMetric) Distance(p1 []float64, p2 []float64) float64 {
+	distance := float64(0)
+	for i, v := range p1 {
+		diff := v - p2[i]
+		distance += diff * diff
+	}
+	return math.Sqrt(distance)
+}
+
+func (m *EuclideanMetric) LowerBound(center []float64, mins []float64, maxs []float64) float64 {
+	distance := float64(0)
+	for i, v := range center {
+		diff := rangeGap(v, mins[i], maxs[i])
+		distance += diff * diff
+	}
+	return math.Sqrt(distance)
+}
+
+func (m *EuclideanMetric) UpperBound(center []float64, mins []float64, maxs []float64) float64 {
+	distance := float64(0)
+	for i, v := range center {
+		diff := rangeSpread(v, mins[i], maxs[i])
+		distance += diff * diff
+	}
+	return math.Sqrt(distance)
+}
+
+func (m *EuclideanMetric) BoxLowerBound(mins1 []float64, maxs1 []float64, mins2 []float64, maxs2 []float64) float64 {
+	distance := float64(0)
+	for i := range mins1 {
+		diff := boxGap(mins1[i], maxs1[i], mins2[i], maxs2[i])
+		distance += diff * diff
+	}
+	return math.Sqrt(distance)
+}
+
+func (m *EuclideanMetric) BoundingBox(center []float64, radius float64) ([]float64, []float64) {
+	return centeredBox(center, uniformWidths(len(center), radius))
+}
+
+type ManhattanMetric struct {
+}
+
+func (m *ManhattanMetric) Distance(p1 []float64, p2 []float64) float64 {
+	distance := float64(0)
+	for i, v := range p1 {
+		distance += math.Abs(v - p2[i])
+	}
+	return distance
+}
+
+func (m *ManhattanMetric) LowerBound(center []float64, mins []float64, maxs []float64) float64 {
+	distance := float64(0)
+	for i, v := range center {
+		distance += rangeGap(v, mins[i], maxs[i])
+	}
+	return distance
+}
+
+func (m *ManhattanMetric) UpperBound(center []float64, mins []float64, maxs []float64) float64 {
+	distance := float64(0)
+	for i, v := range center {
+		distance += rangeSpread(v, mins[i], maxs[i])
+	}
+	return distance
+}
+
+func (m *ManhattanMetric) BoxLowerBound(mins1 []float64, maxs1 []float64, mins2 []float64, maxs2 []float64) float64 {
+	distance := float64(0)
+	for i := range mins1 {
+		distance += boxGap(mins1[i], maxs1[i], mins2[i], maxs2[i])
+	}
+	return distance
+}
+
+func (m *ManhattanMetric) BoundingBox(center []float64, radius float64) ([]float64, []float64) {
+	return centeredBox(center, uniformWidths(len(center), radius))
+}
+
+// Euclidean distance with every dim scaled by its weight
+type WeightedMetric struct {
+	Weights []float64
+}
+
+func (m *WeightedMetric) Distance(p1 []float64, p2 []float64) float64 {
+	distance := float64(0)
+	for i, v := range p1 {
+		diff := (v - p2[i]) * m.Weights[i]
+		distance += diff * diff
+	}
+	return math.Sqrt(distance)
+}
+
+func (m *WeightedMetric) LowerBound(center []float64, mins []float64, maxs []float64) float64 {
+	distance := float64(0)
+	for i, v := range center {
+		diff := rangeGap(v, mins[i], maxs[i]) * m.Weights[i]
+		distance += diff * diff
+	}
+	return math.Sqrt(distance)
+}
+
+func (m *WeightedMetric) UpperBound(center []float64, mins []float64, maxs []float64) float64 {
+	distance := float64(0)
+	for i, v := range center {
+		if m.Weights[i] == 0 {
+			continue
+		}
+		diff := rangeSpread(v, mins[i], maxs[i]) * m.Weights[i]
+		distance += diff * diff
+	}
+	return math.Sqrt(distance)
+}
+
+func (m *WeightedMetric) BoxLowerBound(mins1 []float64, maxs1 []float64, mins2 []float64, maxs2 []float64) float64 {
+	distance := float64(0)
+	for i := range mins1 {
+		diff := boxGap(mins1[i], maxs1[i], mins2[i], maxs2[i]) * m.Weights[i]
+		distance += diff * diff
+	}
+	return math.Sqrt(distance)
+}
+
+// A dim with zero weight never contributes, so it is unbounded
+func (m *WeightedMetric) BoundingBox(center []float64, radius float64) ([]float64, []float64) {
+	halfWidths := make([]float64, len(center))
+	for i, w := range m.Weights {
+		halfWidths[i] = radius / math.Abs(w)
+	}
+	return centeredBox(center, halfWidths)
+}
+
+/*
+Metric measuring only the values at Inds with Metric, in the order of Inds
+Used when the values have dims the query does not measure, which are unbounded
+*/
+type ProjectedMetric struct {
+	Metric DistanceMetric
+	Inds   []int
+}
+
+func (m *ProjectedMetric) project(vals []float64) []float64 {
+	projected := make([]float64, len(m.Inds))
+	for i, ind := range m.Inds {
+		projected[i] = vals[ind]
+	}
+	return projected
+}
+
+func (m *ProjectedMetric) Distance(p1 []float64, p2 []float64) float64 {
+	return m.Metric.Distance(m.project(p1), m.project(p2))
+}
+
+func (m *ProjectedMetric) LowerBound(center []float64, mins []float64, maxs []float64) float64 {
+	return m.Metric.LowerBound(m.project(center), m.project(mins), m.project(maxs))
+}
+
+func (m *ProjectedMetric) UpperBound(center []float64, mins []float64, maxs []float64) float64 {
+	return m.Metric.UpperBound(m.project(center), m.project(mins), m.project(maxs))
+}
+
+func (m *ProjectedMetric) BoxLowerBound(mins1 []float64, maxs1 []float64, mins2 []float64, maxs2 []float64) float64 {
+	return m.Metric.BoxLowerBound(m.project(mins1), m.project(maxs1), m.project(mins2), m.project(maxs2))
+}
+
+func (m *ProjectedMetric) BoundingBox(center []float64, radius float64) ([]float64, []float64) {
+	mins, maxs := centeredBox(center, uniformWidths(len(center), math.Inf(1)))
+	projMins, projMaxs := m.Metric.BoundingBox(m.project(center), radius)
+	for i, ind := range m.Inds {
+		mins[ind], maxs[ind] = projMins[i], projMaxs[i]
+	}
+	return mins, maxs
+}
+
+// Great-circle distance in metres, values in degrees
+// Only the latitude and longitude positions are used, other dims are ignored
+type HaversineMetric struct {
+	LatInd int
+	LonInd int
+}
+
+func toRadians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(1, a)))
+}
+
+func (m *HaversineMetric) Distance(p1 []float64, p2 []float64) float64 {
+	return haversine(p1[m.LatInd], p1[m.LonInd], p2[m.LatInd], p2[m.LonInd])
+}
+
+/*
+The nearest point of a lat/lon box lies on its nearest meridian edge when the center
+is outside the longitude range, otherwise straight north or south of the center.
+On a meridian the nearest point to the center is at latitude atan(tan(lat) / cos(dLon)),
+its distance is the cross track distance asin(cos(lat) * sin(dLon))
+*/
+func (m *HaversineMetric) LowerBound(center []float64, mins []float64, maxs []float64) float64 {
+	lat, lon := center[m.LatInd], center[m.LonInd]
+	latMin, latMax := mins[m.LatInd], maxs[m.LatInd]
+	lonGap := rangeGap(lon, mins[m.LonInd], maxs[m.LonInd])
+	latGap := rangeGap(lat, latMin, latMax)
+	if lonGap == 0 {
+		return earthRadius * toRadians(latGap)
+	}
+	if lonGap >= 90 {
+		// Far away, fall back to the meridian distance which never overestimates
+		return earthRadius * toRadians(latGap)
+	}
+	edgeLon := mins[m.LonInd]
+	if lon > maxs[m.LonInd] {
+		edgeLon = maxs[m.LonInd]
+	}
+	nearestLat := math.Atan(math.Tan(toRadians(lat))/math.Cos(toRadians(lonGap))) * 180 / math.Pi
+	if nearestLat >= latMin && nearestLat <= latMax {
+		return earthRadius * math.Asin(math.Abs(math.Cos(toRadians(lat))*math.Sin(toRadians(lonGap))))
+	}
+	return math.Min(haversine(lat, lon, latMin, edgeLon), haversine(lat, lon, latMax, edgeLon))
+}
+
+/*
+Each factor of the haversine term is bounded on its own: sin^2(dLat/2) by the farthest latitude,
+cos(lat2) by the latitude of the box nearest the equator, and sin^2(dLon/2) by the farthest
+longitude, which reaches its maximum at 180 degrees
+*/
+func (m *HaversineMetric) UpperBound(center []float64, mins []float64, maxs []float64) float64 {
+	lat, lon := center[m.LatInd], center[m.LonInd]
+	latMin, latMax := mins[m.LatInd], maxs[m.LatInd]
+	latSpread := math.Min(rangeSpread(lat, latMin, latMax), 180)
+	lonSpread := math.Min(rangeSpread(lon, mins[m.LonInd], maxs[m.LonInd]), 180)
+	cosLat2 := float64(1)
+	if latMin > 0 || latMax < 0 {
+		cosLat2 = math.Cos(toRadians(math.Min(math.Abs(latMin), math.Abs(latMax))))
+	}
+	sinLat, sinLon := math.Sin(toRadians(latSpread)/2), math.Sin(toRadians(lonSpread)/2)
+	a := sinLat*sinLat + math.Cos(toRadians(lat))*cosLat2*sinLon*sinLon
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(1, a)))
+}
+
+/*
+The haversine term sin^2(dLat/2) + cos(lat1)cos(lat2)sin^2(dLon/2) is at least each of
+sin^2(latGap/2) and cos^2(maxLat)sin^2(dLon/2), where maxLat is the largest absolute latitude
+of the boxes and dLon ranges over the longitude differences between the boxes
+*/
+func (m *HaversineMetric) BoxLowerBound(mins1 []float64, maxs1 []float64, mins2 []float64, maxs2 []float64) float64 {
+	latGap := boxGap(mins1[m.LatInd], maxs1[m.LatInd], mins2[m.LatInd], maxs2[m.LatInd])
+	lonGap := boxGap(mins1[m.LonInd], maxs1[m.LonInd], mins2[m.LonInd], maxs2[m.LonInd])
+	maxLat := math.Max(math.Max(math.Abs(mins1[m.LatInd]), math.Abs(maxs1[m.LatInd])),
+		math.Max(math.Abs(mins2[m.LatInd]), math.Abs(maxs2[m.LatInd])))
+	lonSpan := math.Max(maxs2[m.LonInd]-mins1[m.LonInd], maxs1[m.LonInd]-mins2[m.LonInd])
+	lonTerm := float64(0)
+	if maxLat < 90 && lonGap < 180 && lonSpan < 360 {
+		// sin^2(x/2) has no minimum inside [lonGap, lonSpan]
+		sinGap, sinSpan := math.Sin(toRadians(lonGap)/2), math.Sin(toRadians(lonSpan)/2)
+		cosLat := math.Cos(toRadians(maxLat))
+		lonTerm = cosLat * cosLat * math.Min(sinGap*sinGap, sinSpan*sinSpan)
+	}
+	sinLat := math.Sin(toRadians(math.Min(latGap, 180)) / 2)
+	a := math.Max(sinLat*sinLat, lonTerm)
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(1, a)))
+}
+
+// The longitude extent of a spherical cap is asin(sin(r) / cos(lat)), the whole circle
+// when the cap covers a pole
+func (m *HaversineMetric) BoundingBox(center []float64, radius float64) ([]float64, []float64) {
+	halfWidths := uniformWidths(len(center), math.Inf(1))
+	angle := radius / earthRadius
+	halfWidths[m.LatInd] = angle * 180 / math.Pi
+	halfWidths[m.LonInd] = 180
+	ratio := math.Sin(angle) / math.Cos(toRadians(center[m.LatInd]))
+	if angle < math.Pi/2 && ratio < 1 {
+		halfWidths[m.LonInd] = math.Asin(ratio) * 180 / math.Pi
+	}
+	return centeredBox(center, halfWidths)
+}
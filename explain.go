@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Explain modes of queries
+const (
+	explainNone = iota
+	explainPlan
+	explainAnalyze
+)
+
+// How a leaf is read, see Worker.chooseRead
+const (
+	readNone   = "none"
+	readSingle = "single"
+	readBatch  = "batch"
+	readAll    = "all"
+)
+
+// Plan of one leaf of the query
+type PlanLeaf struct {
+	CubeInd int
+	// Worker owning the leaf per cubeList
+	Owner int
+	// Whether the meta of the cube is cached in DB.Cube, and its data array loaded
+	Cached bool
+	Loaded bool
+	// readNone, readSingle, readBatch or readAll
+	Read string
+	// Cells overlapping the query, and their points from CubeCell.Count
+	MetaInds  []int
+	Estimated int
+	// Points of the whole cube, -1 with Estimated when the cube is not stored on this worker
+	CubePoints int
+	// ANALYZE: points read and matching, and the time spent reading the leaf
+	Drawn    int
+	Matched  int
+	ReadTime time.Duration
+}
+
+// Time spent in a stage of ANALYZE and the number of nodes or points it produced
+type PlanStage struct {
+	Name     string
+	Duration time.Duration
+	Count    int
+}
+
+// Plan of an equality or range query, see Worker.ExplainQuery
+type Plan struct {
+	QueryType int
+	// Tree search of the query and the nodes it visited, pruned ones included
+	Search  string
+	Visited []int
+	Leaves  []PlanLeaf
+	// Points in the cells overlapping the query, on the leaves stored here
+	Estimated int
+	// ANALYZE
+	Analyzed bool
+	Stages   []PlanStage
+	Returned int
+}
+
+/*
+Return the plan of an equality or range query: the tree nodes visited, the leaves and cells
+read, their owners and cache state, and the points estimated from the cell counts
+With query.Explain = explainAnalyze the plan is executed, filling the actual counts and the
+time of each stage
+*/
+func (worker *Worker) ExplainQuery(query *Query) (*Plan, error) {
+	plan := &Plan{QueryType: query.QueryType, Search: "RangeSearch"}
+	start := time.Now()
+	cubeInds, visited, err := worker.searchLeaves(query)
+	if err != nil {
+		return nil, err
+	}
+	plan.Visited = visited
+	if query.QueryType == 0 {
+		// the nodes on the paths to every leaf holding the values
+		plan.Search = "EquatlitySearch"
+		seen := make(map[int]bool)
+		for _, cubeInd := range cubeInds {
+			for _, nodeInd := range worker.dTree.PathTo(cubeInd) {
+				if !seen[nodeInd] {
+					seen[nodeInd] = true
+					plan.Visited = append(plan.Visited, nodeInd)
+				}
+			}
+		}
+	}
+	searchTime := time.Since(start)
+
+	start = time.Now()
+	for _, cubeInd := range cubeInds {
+		leaf, err := worker.planLeaf(query, cubeInd)
+		if err != nil {
+			return nil, err
+		}
+		plan.Leaves = append(plan.Leaves, leaf)
+		if leaf.Estimated > 0 {
+			plan.Estimated += leaf.Estimated
+		}
+	}
+	if query.Explain == explainAnalyze {
+		plan.Stages = []PlanStage{{"search", searchTime, len(cubeInds)}, {"plan", time.Since(start), plan.Estimated}}
+		worker.analyzePlan(query, plan)
+	}
+	return plan, nil
+}
+
+// Leaves of an equality or range query, and for a range query the nodes visited to find them
+func (worker *Worker) searchLeaves(query *Query) ([]int, []int, error) {
+	switch query.QueryType {
+	case 0:
+		if err := query.ValidatePredicate(); err != nil {
+			return nil, nil, err
+		}
+		cubeInds, err := worker.dTree.EquatlitySearch(query.QueryDims, query.QueryDimVals)
+		return cubeInds, nil, err
+	case 1:
+		if err := query.ValidateRegion(); err != nil {
+			return nil, nil, err
+		}
+		return worker.dTree.PredicateSearchTrace(query.ToPredicate())
+	}
+	err := errors.New(fmt.Sprintf("Query type %d is not an equality or range query", query.QueryType))
+	fmt.Println(err)
+	return nil, nil, err
+}
+
+// Plan the read of a leaf, without loading it into the cache
+func (worker *Worker) planLeaf(query *Query, cubeInd int) (PlanLeaf, error) {
+	node := &worker.dTree.Nodes[cubeInd]
+	leaf := PlanLeaf{CubeInd: cubeInd, Owner: worker.cubeList[cubeInd], Estimated: -1, CubePoints: -1}
+	if cube, exists := worker.db.Cube[cubeInd]; exists {
+		leaf.Cached = true
+		leaf.Loaded = len(cube.DataArr) > 0
+	}
+	if query.QueryType == 0 {
+		metaInd, err := node.MapIndByVal(query.QueryDims, query.QueryDimVals)
+		if err != nil {
+			return leaf, err
+		}
+		leaf.Read, leaf.MetaInds = readSingle, []int{metaInd}
+	} else {
+		insideInds, partialInds := node.RegionCells(query)
+		leaf.MetaInds = append(insideInds, partialInds...)
+		sort.Ints(leaf.MetaInds)
+	}
+	if metaInfo := worker.db.PeekMeta(cubeInd); metaInfo != nil {
+		leaf.Estimated, leaf.CubePoints = 0, 0
+		for _, metaInd := range leaf.MetaInds {
+			leaf.Estimated += metaInfo.CellArr[metaInd].Count
+		}
+		for _, cell := range metaInfo.CellArr {
+			leaf.CubePoints += cell.Count
+		}
+	}
+	// the cell of an equality query is read alone unless the leaf is scanned by another owner
+	if query.QueryType != 0 || leaf.Owner != worker.id {
+		leaf.Read = worker.chooseRead(&leaf)
+	}
+	return leaf, nil
+}
+
+/*
+Pick how to read the cells of a leaf from their counts
+A leaf owned by another worker, or without counts, is scanned whole by its owner, a leaf
+whose cells hold more than readSingleAllRatio of its points is scanned whole too, as the
+scan decodes the data array in order. Otherwise only the cells are read: one by one from
+the data file when they hold at most batchReadThres points and the data array is not in
+memory, else in a batch loading the data array
+*/
+func (worker *Worker) chooseRead(leaf *PlanLeaf) string {
+	switch {
+	case leaf.Owner != worker.id || leaf.Estimated < 0:
+		return readAll
+	case leaf.Estimated == 0:
+		return readNone
+	case float64(leaf.Estimated) > readSingleAllRatio*float64(leaf.CubePoints):
+		return readAll
+	case !leaf.Loaded && leaf.Estimated <= batchReadThres:
+		return readSingle
+	default:
+		return readBatch
+	}
+}
+
+// Read the points of a leaf as planned, decoding only dims, nil for every dim
+func (worker *Worker) readLeaf(leaf *PlanLeaf, dims []uint) []DataPoint {
+	switch leaf.Read {
+	case readNone:
+		return nil
+	case readSingle:
+		var dPoints []DataPoint
+		for _, metaInd := range leaf.MetaInds {
+			dPoints = append(dPoints, worker.db.ReadSingleColumns(leaf.CubeInd, metaInd, dims)...)
+		}
+		return dPoints
+	case readBatch:
+		return worker.db.ReadBatchColumns(leaf.CubeInd, leaf.MetaInds, dims)
+	default:
+		return worker.getAll([]int{leaf.CubeInd}, dims)
+	}
+}
+
+// Execute the plan leaf by leaf, as EqualityQuery and RangeQuery read them
+func (worker *Worker) analyzePlan(query *Query, plan *Plan) {
+	decodeDims := query.decodeDims()
+	var readTime, filterTime time.Duration
+	drawn := 0
+	for i := range plan.Leaves {
+		leaf := &plan.Leaves[i]
+		start := time.Now()
+		dPoints := worker.readLeaf(leaf, decodeDims)
+		leaf.ReadTime = time.Since(start)
+		readTime += leaf.ReadTime
+
+		start = time.Now()
+		for _, dp := range dPoints {
+			if query.CheckPoint(&dp) {
+				leaf.Matched++
+			}
+		}
+		filterTime += time.Since(start)
+		leaf.Drawn = len(dPoints)
+		drawn += leaf.Drawn
+		plan.Returned += leaf.Matched
+	}
+	plan.Stages = append(plan.Stages, PlanStage{"read", readTime, drawn}, PlanStage{"filter", filterTime, plan.Returned})
+	plan.Analyzed = true
+}
+
+// Readable form of the plan, one line per leaf and per stage, the cells of a leaf are in MetaInds
+func (plan *Plan) String() string {
+	var b strings.Builder
+	mode := "EXPLAIN"
+	if plan.Analyzed {
+		mode = "ANALYZE"
+	}
+	fmt.Fprintf(&b, "%s query type %d: %s visited %d nodes %v, %d leaves, estimated %d points\n",
+		mode, plan.QueryType, plan.Search, len(plan.Visited), plan.Visited, len(plan.Leaves), plan.Estimated)
+	for _, leaf := range plan.Leaves {
+		state := "not cached"
+		if leaf.Loaded {
+			state = "cached with data"
+		} else if leaf.Cached {
+			state = "cached meta"
+		}
+		fmt.Fprintf(&b, "  leaf %d on worker %d (%s): read %s, %d cells", leaf.CubeInd, leaf.Owner, state, leaf.Read, len(leaf.MetaInds))
+		if leaf.Estimated >= 0 {
+			fmt.Fprintf(&b, ", estimated %d of %d points", leaf.Estimated, leaf.CubePoints)
+		} else {
+			fmt.Fprintf(&b, ", counts not stored on this worker")
+		}
+		if plan.Analyzed {
+			fmt.Fprintf(&b, ", drawn %d matched %d in %v", leaf.Drawn, leaf.Matched, leaf.ReadTime)
+		}
+		b.WriteString("\n")
+	}
+	for _, stage := range plan.Stages {
+		fmt.Fprintf(&b, "  stage %s: %v, %d\n", stage.Name, stage.Duration, stage.Count)
+	}
+	if plan.Analyzed {
+		fmt.Fprintf(&b, "  returned %d points\n", plan.Returned)
+	}
+	return b.String()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// EXPLAIN of an equality query on a leaf of the other worker plans its read by the owner,
+// and ANALYZE reads the leaf from it
+func TestExplainEqualityRemoteLeaf(t *testing.T) {
+	points := testPoints(3000)
+	worker, _ := testCluster(t, points)
+	dims := []uint{0, 1, 2}
+	var query *Query
+	var cubeInds []int
+	for i := range points {
+		query = InitQuery(0, dims, points[i].FArr, []int{0, 0, 0}, -1, "")
+		cubeInds, _ = worker.dTree.EquatlitySearch(query.QueryDims, query.QueryDimVals)
+		if worker.cubeList[cubeInds[0]] != worker.id {
+			break
+		}
+	}
+	query.SetExplain(true)
+	plan, err := worker.ExplainQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Leaves) != 1 || plan.Leaves[0].CubeInd != cubeInds[0] || plan.Leaves[0].Owner == worker.id {
+		t.Fatalf("planned leaves %+v, want leaf %d of the other worker", plan.Leaves, cubeInds[0])
+	}
+	if plan.Leaves[0].Read != readAll {
+		t.Fatalf("leaf read %s, want %s", plan.Leaves[0].Read, readAll)
+	}
+	if want := worker.dTree.PathTo(cubeInds[0]); !reflect.DeepEqual(plan.Visited, want) {
+		t.Fatalf("visited %v, want %v", plan.Visited, want)
+	}
+	if plan.Returned != 1 {
+		t.Fatalf("returned %d points, want 1", plan.Returned)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+/*
+Heatmap is a Width x Height grid of pixels over the box [Mins, Maxs] of two dims,
+Values is row major, the pixel of column x and row y is Values[y*Width+x]
+Pixels are half open except the last column and row, which include Maxs
+*/
+type Heatmap struct {
+	Mins   []float64
+	Maxs   []float64
+	Width  int
+	Height int
+	Values []float64
+}
+
+func InitHeatmap(mins []float64, maxs []float64, width int, height int) (*Heatmap, error) {
+	if len(mins) != 2 || len(maxs) != 2 {
+		err := errors.New(fmt.Sprintf("Heatmap requires 2 dims, got %d mins and %d maxs", len(mins), len(maxs)))
+		fmt.Println(err)
+		return nil, err
+	}
+	if width <= 0 || height <= 0 {
+		err := errors.New(fmt.Sprintf("Heatmap resolution %dx%d is not positive", width, height))
+		fmt.Println(err)
+		return nil, err
+	}
+	if !(mins[0] < maxs[0]) || !(mins[1] < maxs[1]) {
+		err := errors.New(fmt.Sprintf("Heatmap box %v - %v is empty", mins, maxs))
+		fmt.Println(err)
+		return nil, err
+	}
+	hm := new(Heatmap)
+	hm.Mins = []float64{mins[0], mins[1]}
+	hm.Maxs = []float64{maxs[0], maxs[1]}
+	hm.Width = width
+	hm.Height = height
+	hm.Values = make([]float64, width*height)
+	return hm, nil
+}
+
+// Empty heatmap with the same grid
+func (hm *Heatmap) emptyCopy() *Heatmap {
+	res, _ := InitHeatmap(hm.Mins, hm.Maxs, hm.Width, hm.Height)
+	return res
+}
+
+// Pixel index of v along dim i (0 x, 1 y), false when v is outside the box
+func (hm *Heatmap) pixelInd1d(i int, v float64) (int, bool) {
+	if v < hm.Mins[i] || v > hm.Maxs[i] || math.IsNaN(v) {
+		return -1, false
+	}
+	n := hm.Width
+	if i == 1 {
+		n = hm.Height
+	}
+	ind := int(float64(n) * (v - hm.Mins[i]) / (hm.Maxs[i] - hm.Mins[i]))
+	if ind >= n {
+		ind = n - 1
+	}
+	return ind, true
+}
+
+// Index in Values of the pixel containing (x, y), false when outside the box
+func (hm *Heatmap) PixelInd(x, y float64) (int, bool) {
+	col, xIn := hm.pixelInd1d(0, x)
+	row, yIn := hm.pixelInd1d(1, y)
+	if !xIn || !yIn {
+		return -1, false
+	}
+	return row*hm.Width + col, true
+}
+
+// Index in Values of the single pixel containing the whole box, false when the box
+// straddles a pixel edge or leaves the heatmap
+func (hm *Heatmap) BoxPixelInd(xmin, ymin, xmax, ymax float64) (int, bool) {
+	lo, loIn := hm.PixelInd(xmin, ymin)
+	hi, hiIn := hm.PixelInd(xmax, ymax)
+	if !loIn || !hiIn || lo != hi {
+		return -1, false
+	}
+	return lo, true
+}
+
+func (hm *Heatmap) Merge(other *Heatmap) error {
+	if len(other.Values) != len(hm.Values) {
+		err := errors.New(fmt.Sprintf("Cannot merge heatmap of %d pixels into %d pixels", len(other.Values), len(hm.Values)))
+		fmt.Println(err)
+		return err
+	}
+	for i, v := range other.Values {
+		hm.Values[i] += v
+	}
+	return nil
+}
+
+/*
+Compute the heatmap of the query on the cubes owned by this worker
+Cells lying in a single pixel are added as a whole, from CubeCell.Count or the
+per-cell sum, only the cells straddling pixel edges are decoded and binned by point
+*/
+func (worker *Worker) HeatmapQuery(query *Query) (*Heatmap, error) {
+	if err := query.ValidateHeatmap(); err != nil {
+		return nil, err
+	}
+	hm := query.Heatmap.emptyCopy()
+	xDim, yDim := query.QueryDims[0], query.QueryDims[1]
+	region := query.heatmapPredicate()
+	cubeInds, err := worker.dTree.PredicateSearch(region)
+	if err != nil {
+		return nil, err
+	}
+	for _, cubeInd := range cubeInds {
+		if worker.cubeList[cubeInd] != worker.id {
+			continue
+		}
+		node := &worker.dTree.Nodes[cubeInd]
+		// when the grid is not on the dims of the cube every cell is binned by point
+		xInd, yInd, dimErr := polygonDimInds(node.Dims, xDim, yDim)
+		boxMins := make([]float64, len(node.Dims))
+		boxMaxs := make([]float64, len(node.Dims))
+		for i := range boxMins {
+			boxMins[i], boxMaxs[i] = math.Inf(-1), math.Inf(1)
+		}
+		if dimErr == nil {
+			boxMins[xInd], boxMins[yInd] = hm.Mins[0], hm.Mins[1]
+			boxMaxs[xInd], boxMaxs[yInd] = hm.Maxs[0], hm.Maxs[1]
+		}
+		lo, hi, overlap := node.GridRange(boxMins, boxMaxs)
+		if !overlap {
+			continue
+		}
+		var straddleInds []int
+		for _, metaInd := range node.MetaIndsInGridRange(lo, hi) {
+			cellMins, cellMaxs, _ := node.Boundary(metaInd)
+			check := region.BoxCheck(node.Dims, cellMins, cellMaxs)
+			if check == boxOutside {
+				continue
+			}
+			pixel, single := -1, false
+			if dimErr == nil {
+				pixel, single = hm.BoxPixelInd(cellMins[xInd], cellMins[yInd], cellMaxs[xInd], cellMaxs[yInd])
+			}
+			if !single || check != boxInside {
+				straddleInds = append(straddleInds, metaInd)
+			} else if query.AggFunc == aggCount {
+				hm.Values[pixel] += float64(worker.db.CellCount(cubeInd, metaInd))
+			} else if cellAgg := worker.db.CellAggregate(cubeInd, metaInd, query.AggDim); cellAgg != nil {
+				hm.Values[pixel] += cellAgg.Sum
+			} else {
+				straddleInds = append(straddleInds, metaInd)
+			}
+		}
+		if len(straddleInds) == 0 {
+			continue
+		}
+		for _, dp := range worker.db.ReadBatch(cubeInd, straddleInds) {
+			if !region.Eval(&dp) {
+				continue
+			}
+			pixel, in := hm.PixelInd(dp.getFloatValByDim(xDim), dp.getFloatValByDim(yDim))
+			if !in {
+				continue
+			}
+			if query.AggFunc == aggCount {
+				hm.Values[pixel]++
+			} else {
+				hm.Values[pixel] += dp.getFloatValByDim(query.AggDim)
+			}
+		}
+	}
+	return hm, nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// Root path of the cubes of the dataset joined by QueryType = 11
+	joinDBRootPath = "./joindb/"
+	// Pairs sent to the client in one message while a join runs
+	joinBatchSize = 1000
+)
+
+// A pair of points within the join radius, Left from the left dataset and Right from the right one
+type JoinPair struct {
+	Left     DataPoint
+	Right    DataPoint
+	Distance float64
+}
+
+// Number of left points within the join radius of the right point at Position
+type JoinCount struct {
+	Right    DataPoint
+	Position Cursor
+	Count    int
+}
+
+// Number of pairs of a join query, the pairs themselves are streamed in batches, or the
+// counts per right point of a join query with JoinCount
+type JoinResult struct {
+	PairNum int
+	Counts  []JoinCount
+}
+
+/*
+SpatialJoin pairs the points of two datasets, each a DTree with its DB, that are within
+Radius of each other, comparing the values of LeftDims on the left with RightDims on the right
+Metric codes follow Query.Metric, haversine takes LeftDims[0] and RightDims[0] as latitudes
+Each DB needs its own root path, see InitDBAt, as the cube indices of two trees overlap
+*/
+type SpatialJoin struct {
+	LeftDims  []uint
+	RightDims []uint
+	Radius    float64
+	Metric    DistanceMetric
+	// Whether a leaf of the left tree takes part in the join, nil for every leaf
+	LeftLeaves func(cubeInd int) bool
+}
+
+func InitSpatialJoin(leftDims []uint, rightDims []uint, radius float64, metric int, weights []float64) (*SpatialJoin, error) {
+	if len(leftDims) == 0 || len(leftDims) != len(rightDims) {
+		err := errors.New(fmt.Sprintf("Spatial join requires the same number of dims on both sides, got %d and %d", len(leftDims), len(rightDims)))
+		fmt.Println(err)
+		return nil, err
+	}
+	if radius < 0 {
+		err := errors.New(fmt.Sprintf("Spatial join radius %f is negative", radius))
+		fmt.Println(err)
+		return nil, err
+	}
+	// the metric works on values aligned with LeftDims
+	q := InitQuery(0, leftDims, nil, nil, 0, "")
+	q.SetMetric(metric, weights)
+	distanceMetric, err := q.DistanceMetric(leftDims)
+	if err != nil {
+		return nil, err
+	}
+	join := new(SpatialJoin)
+	join.LeftDims = make([]uint, len(leftDims))
+	copy(join.LeftDims, leftDims)
+	join.RightDims = make([]uint, len(rightDims))
+	copy(join.RightDims, rightDims)
+	join.Radius = radius
+	join.Metric = distanceMetric
+	return join, nil
+}
+
+// Project the box [mins, maxs] on dims onto the join dims, unbounded on the join dims not in dims
+func joinBox(dims []uint, mins []float64, maxs []float64, joinDims []uint) ([]float64, []float64) {
+	boxMins := make([]float64, len(joinDims))
+	boxMaxs := make([]float64, len(joinDims))
+	for i, jd := range joinDims {
+		boxMins[i], boxMaxs[i] = math.Inf(-1), math.Inf(1)
+		for j, d := range dims {
+			if d == jd {
+				boxMins[i], boxMaxs[i] = mins[j], maxs[j]
+				break
+			}
+		}
+	}
+	return boxMins, boxMaxs
+}
+
+// Sum of the finite widths of the box
+func boxExtent(mins []float64, maxs []float64) float64 {
+	extent := float64(0)
+	for i := range mins {
+		if width := maxs[i] - mins[i]; !math.IsInf(width, 0) {
+			extent += width
+		}
+	}
+	return extent
+}
+
+// A non-empty cell of a leaf with its box on the join dims
+type joinCell struct {
+	metaInd int
+	mins    []float64
+	maxs    []float64
+}
+
+// Non-empty cells of the leaf within the radius of the box [mins, maxs] on the join dims
+func (join *SpatialJoin) nearCells(node *DTreeNode, cubeInd int, db *DB, joinDims []uint, mins []float64, maxs []float64) []joinCell {
+	var cells []joinCell
+	for metaInd := 0; metaInd < int(node.Capacity); metaInd++ {
+		cellMins, cellMaxs, _ := node.Boundary(metaInd)
+		boxMins, boxMaxs := joinBox(node.Dims, cellMins, cellMaxs, joinDims)
+		if join.Metric.BoxLowerBound(boxMins, boxMaxs, mins, maxs) > join.Radius {
+			continue
+		}
+		if db.CellCount(cubeInd, metaInd) == 0 {
+			continue
+		}
+		cells = append(cells, joinCell{metaInd, boxMins, boxMaxs})
+	}
+	return cells
+}
+
+// Join the points of two leaves, the right points are read cell by cell when first needed
+func (join *SpatialJoin) joinLeaves(leftTree *DTree, leftDB *DB, leftInd int, rightTree *DTree, rightDB *DB, rightInd int, out chan<- JoinPair) {
+	leftNode, rightNode := &leftTree.Nodes[leftInd], &rightTree.Nodes[rightInd]
+	leftMins, leftMaxs := joinBox(leftNode.Dims, leftNode.Mins, leftNode.Maxs, join.LeftDims)
+	rightMins, rightMaxs := joinBox(rightNode.Dims, rightNode.Mins, rightNode.Maxs, join.RightDims)
+	leftCells := join.nearCells(leftNode, leftInd, leftDB, join.LeftDims, rightMins, rightMaxs)
+	if len(leftCells) == 0 {
+		return
+	}
+	rightCells := join.nearCells(rightNode, rightInd, rightDB, join.RightDims, leftMins, leftMaxs)
+	if len(rightCells) == 0 {
+		return
+	}
+	rightPoints := make(map[int][]DataPoint)
+	for _, leftCell := range leftCells {
+		for _, lp := range leftDB.ReadSingle(leftInd, leftCell.metaInd) {
+			lVals := lp.getFloatValsByDims(join.LeftDims)
+			for _, rightCell := range rightCells {
+				if join.Metric.LowerBound(lVals, rightCell.mins, rightCell.maxs) > join.Radius {
+					continue
+				}
+				points, exists := rightPoints[rightCell.metaInd]
+				if !exists {
+					points = rightDB.ReadSingle(rightInd, rightCell.metaInd)
+					rightPoints[rightCell.metaInd] = points
+				}
+				for _, rp := range points {
+					distance := join.Metric.Distance(lVals, rp.getFloatValsByDims(join.RightDims))
+					if distance <= join.Radius {
+						out <- JoinPair{Left: lp, Right: rp, Distance: distance}
+					}
+				}
+			}
+		}
+	}
+}
+
+// Count the left points within the radius of each right point of two leaves into counts,
+// a left cell entirely within the radius of a right point is counted from CubeCell.Count
+func (join *SpatialJoin) countLeaves(leftTree *DTree, leftDB *DB, leftInd int, rightTree *DTree, rightDB *DB, rightInd int, counts map[Cursor]*JoinCount) {
+	leftNode, rightNode := &leftTree.Nodes[leftInd], &rightTree.Nodes[rightInd]
+	leftMins, leftMaxs := joinBox(leftNode.Dims, leftNode.Mins, leftNode.Maxs, join.LeftDims)
+	rightMins, rightMaxs := joinBox(rightNode.Dims, rightNode.Mins, rightNode.Maxs, join.RightDims)
+	rightCells := join.nearCells(rightNode, rightInd, rightDB, join.RightDims, leftMins, leftMaxs)
+	if len(rightCells) == 0 {
+		return
+	}
+	leftCells := join.nearCells(leftNode, leftInd, leftDB, join.LeftDims, rightMins, rightMaxs)
+	if len(leftCells) == 0 {
+		return
+	}
+	leftPoints := make(map[int][]DataPoint)
+	for _, rightCell := range rightCells {
+		for offset, rp := range rightDB.ReadSingle(rightInd, rightCell.metaInd) {
+			rVals := rp.getFloatValsByDims(join.RightDims)
+			count := 0
+			for _, leftCell := range leftCells {
+				if join.Metric.LowerBound(rVals, leftCell.mins, leftCell.maxs) > join.Radius {
+					continue
+				}
+				if join.Metric.UpperBound(rVals, leftCell.mins, leftCell.maxs) <= join.Radius {
+					count += leftDB.CellCount(leftInd, leftCell.metaInd)
+					continue
+				}
+				points, exists := leftPoints[leftCell.metaInd]
+				if !exists {
+					points = leftDB.ReadSingleColumns(leftInd, leftCell.metaInd, join.LeftDims)
+					leftPoints[leftCell.metaInd] = points
+				}
+				for _, lp := range points {
+					if join.Metric.Distance(lp.getFloatValsByDims(join.LeftDims), rVals) <= join.Radius {
+						count++
+					}
+				}
+			}
+			position := Cursor{CubeInd: rightInd, MetaInd: rightCell.metaInd, Offset: offset}
+			if jc, exists := counts[position]; exists {
+				jc.Count += count
+			} else {
+				counts[position] = &JoinCount{Right: rp, Position: position, Count: count}
+			}
+		}
+	}
+}
+
+/*
+Stream every pair of points within the radius into out, and close out when done
+The two trees are walked together from the roots, node pairs whose boxes are farther apart
+than the radius are pruned, the larger node of a pair is split first, and the cells
+of two leaves are pruned again before any point is read
+*/
+func (join *SpatialJoin) Run(leftTree *DTree, leftDB *DB, rightTree *DTree, rightDB *DB, out chan<- JoinPair) {
+	defer close(out)
+	join.walk(leftTree, rightTree, func(leftInd int, rightInd int) {
+		join.joinLeaves(leftTree, leftDB, leftInd, rightTree, rightDB, rightInd, out)
+	})
+}
+
+// Number of left points within the radius of each right point, 0 for right points without any
+// The trees are walked as in Run, without reading the left cells entirely within the radius
+func (join *SpatialJoin) Count(leftTree *DTree, leftDB *DB, rightTree *DTree, rightDB *DB) []JoinCount {
+	counts := zeroCounts(rightTree, rightDB)
+	join.walk(leftTree, rightTree, func(leftInd int, rightInd int) {
+		join.countLeaves(leftTree, leftDB, leftInd, rightTree, rightDB, rightInd, counts)
+	})
+	return sortedCounts(counts)
+}
+
+// Every point of the tree at count 0, keyed by its position
+func zeroCounts(dTree *DTree, db *DB) map[Cursor]*JoinCount {
+	counts := make(map[Cursor]*JoinCount)
+	for nodeInd := range dTree.Nodes {
+		node := &dTree.Nodes[nodeInd]
+		if !node.IsLeaf || !db.CubeExists(nodeInd) {
+			continue
+		}
+		for metaInd := 0; metaInd < int(node.Capacity); metaInd++ {
+			if db.CellCount(nodeInd, metaInd) == 0 {
+				continue
+			}
+			for offset, dp := range db.ReadSingle(nodeInd, metaInd) {
+				position := Cursor{CubeInd: nodeInd, MetaInd: metaInd, Offset: offset}
+				counts[position] = &JoinCount{Right: dp, Position: position}
+			}
+		}
+	}
+	return counts
+}
+
+// Call visit on every pair of leaves whose boxes are within the radius
+func (join *SpatialJoin) walk(leftTree *DTree, rightTree *DTree, visit func(leftInd int, rightInd int)) {
+	if len(leftTree.Nodes) == 0 || len(rightTree.Nodes) == 0 {
+		return
+	}
+	pairs := [][2]int{{0, 0}}
+	for len(pairs) > 0 {
+		pair := pairs[len(pairs)-1]
+		pairs = pairs[:len(pairs)-1]
+		leftNode, rightNode := &leftTree.Nodes[pair[0]], &rightTree.Nodes[pair[1]]
+		if leftNode.IsLeaf && join.LeftLeaves != nil && !join.LeftLeaves(pair[0]) {
+			continue
+		}
+		leftMins, leftMaxs := joinBox(leftNode.Dims, leftNode.Mins, leftNode.Maxs, join.LeftDims)
+		rightMins, rightMaxs := joinBox(rightNode.Dims, rightNode.Mins, rightNode.Maxs, join.RightDims)
+		if join.Metric.BoxLowerBound(leftMins, leftMaxs, rightMins, rightMaxs) > join.Radius {
+			continue
+		}
+		if leftNode.IsLeaf && rightNode.IsLeaf {
+			visit(pair[0], pair[1])
+			continue
+		}
+		splitLeft := !leftNode.IsLeaf
+		if !leftNode.IsLeaf && !rightNode.IsLeaf {
+			splitLeft = boxExtent(leftMins, leftMaxs) >= boxExtent(rightMins, rightMaxs)
+		}
+		if splitLeft {
+			pairs = append(pairs, [2]int{int(leftNode.LInd), pair[1]}, [2]int{int(leftNode.RInd), pair[1]})
+		} else {
+			pairs = append(pairs, [2]int{pair[0], int(rightNode.LInd)}, [2]int{pair[0], int(rightNode.RInd)})
+		}
+	}
+}
+
+// Counts ordered by the position of their right point
+func sortedCounts(counts map[Cursor]*JoinCount) []JoinCount {
+	result := make([]JoinCount, 0, len(counts))
+	for _, jc := range counts {
+		result = append(result, *jc)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].Position, result[j].Position
+		if a.CubeInd != b.CubeInd {
+			return a.CubeInd < b.CubeInd
+		}
+		if a.MetaInd != b.MetaInd {
+			return a.MetaInd < b.MetaInd
+		}
+		return a.Offset < b.Offset
+	})
+	return result
+}
+
+// Merge the join result of another worker, counts of the same right point are added
+func (result *JoinResult) Merge(other *JoinResult) {
+	result.PairNum += other.PairNum
+	if len(other.Counts) == 0 {
+		return
+	}
+	counts := make(map[Cursor]*JoinCount, len(result.Counts)+len(other.Counts))
+	for _, list := range [][]JoinCount{result.Counts, other.Counts} {
+		for i := range list {
+			if jc, exists := counts[list[i].Position]; exists {
+				jc.Count += list[i].Count
+			} else {
+				jc := list[i]
+				counts[jc.Position] = &jc
+			}
+		}
+	}
+	result.Counts = sortedCounts(counts)
+}
+
+/*
+Join the points of the leaves owned by the worker with the dataset loaded by
+Client.SendJoinDataset, which every worker holds whole
+Pairs are passed to send in batches of at most joinBatchSize as the join produces them,
+the result only holds their number
+*/
+func (worker *Worker) JoinQuery(query *Query, send func(pairs []JoinPair)) (*JoinResult, error) {
+	if worker.joinTree == nil {
+		err := errors.New("No dataset to join, load one with SendJoinDataset")
+		fmt.Println(err)
+		return nil, err
+	}
+	join, err := query.SpatialJoin()
+	if err != nil {
+		return nil, err
+	}
+	join.LeftLeaves = func(cubeInd int) bool {
+		return worker.cubeList[cubeInd] == worker.id
+	}
+	result := new(JoinResult)
+	if query.JoinCount {
+		result.Counts = join.Count(worker.dTree, worker.db, worker.joinTree, worker.joinDB)
+		return result, nil
+	}
+	out := make(chan JoinPair)
+	go join.Run(worker.dTree, worker.db, worker.joinTree, worker.joinDB, out)
+	batch := make([]JoinPair, 0, joinBatchSize)
+	for pair := range out {
+		pair.Left = query.Project(&pair.Left)
+		batch = append(batch, pair)
+		if len(batch) == joinBatchSize {
+			send(batch)
+			result.PairNum += len(batch)
+			batch = make([]JoinPair, 0, joinBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		send(batch)
+		result.PairNum += len(batch)
+	}
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Entrances with FArr = lat, lon, stored under their own root path next to the trips of the worker
+func testJoinDataset(t *testing.T, worker *Worker, n int) []DataPoint {
+	r := rand.New(rand.NewSource(2))
+	entrances := make([]DataPoint, n)
+	for i := range entrances {
+		entrances[i].FArr = []float64{40.6 + 0.3*r.Float64(), -74.1 + 0.3*r.Float64()}
+	}
+	dTree := InitTree([]uint{0, 1}, []uint{4, 4}, 2, testMins[:2], testMaxs[:2])
+	if err := dTree.UpdateTree(entrances); err != nil {
+		t.Fatal(err)
+	}
+	db, _ := InitDBAt(joinDBRootPath)
+	for _, batch := range dTree.ToDataBatch() {
+		if err := db.Feed(&batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	worker.joinTree, worker.joinDB = dTree, db
+	return entrances
+}
+
+// Pickups within the radius of each entrance, counted per entrance, entrances without any
+// included, and streamed as pairs in batches
+func TestJoinQueryCount(t *testing.T) {
+	trips := testPoints(3000)
+	worker := testWorker(t, trips)
+	entrances := testJoinDataset(t, worker, 40)
+	for _, radius := range []float64{0.001, 0.01, 0.05} {
+		want := make(map[[2]float64]int)
+		total := 0
+		for _, e := range entrances {
+			want[[2]float64{e.FArr[0], e.FArr[1]}] = 0
+			for _, p := range trips {
+				if math.Hypot(p.FArr[0]-e.FArr[0], p.FArr[1]-e.FArr[1]) <= radius {
+					want[[2]float64{e.FArr[0], e.FArr[1]}]++
+					total++
+				}
+			}
+		}
+		q, err := InitJoinQuery([]uint{0, 1}, []uint{0, 1}, radius, 0, true, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := worker.JoinQuery(q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Counts) != len(want) {
+			t.Fatalf("radius %v: got %d entrances, want %d", radius, len(result.Counts), len(want))
+		}
+		for _, jc := range result.Counts {
+			if key := [2]float64{jc.Right.FArr[0], jc.Right.FArr[1]}; jc.Count != want[key] {
+				t.Fatalf("radius %v: entrance %v has %d pickups, want %d", radius, key, jc.Count, want[key])
+			}
+		}
+
+		q.JoinCount = false
+		pairNum := 0
+		result, err = worker.JoinQuery(q, func(pairs []JoinPair) {
+			if len(pairs) == 0 || len(pairs) > joinBatchSize {
+				t.Fatalf("radius %v: got a batch of %d pairs", radius, len(pairs))
+			}
+			pairNum += len(pairs)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pairNum != total || result.PairNum != total {
+			t.Fatalf("radius %v: got %d pairs streamed and %d counted, want %d", radius, pairNum, result.PairNum, total)
+		}
+	}
+}
+
+// A worker owning none of the leaves still counts every entrance, at 0
+func TestJoinQueryCountNoOwnedLeaves(t *testing.T) {
+	worker := testWorker(t, testPoints(3000))
+	entrances := testJoinDataset(t, worker, 40)
+	for nodeInd := range worker.dTree.Nodes {
+		worker.cubeList[nodeInd] = 1
+	}
+	q, err := InitJoinQuery([]uint{0, 1}, []uint{0, 1}, 0.05, 0, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := worker.JoinQuery(q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Counts) != len(entrances) {
+		t.Fatalf("got %d entrances, want %d", len(result.Counts), len(entrances))
+	}
+	for _, jc := range result.Counts {
+		if jc.Count != 0 {
+			t.Fatalf("entrance %v has %d pickups, want 0", jc.Right.FArr, jc.Count)
+		}
+	}
+}
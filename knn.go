@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 )
 
@@ -65,6 +66,21 @@ type KNNPoint struct {
 	distance float64
 	vals     []float64
 	dPoint   *DataPoint
+	// (cube index, meta index) of a cell in the cell heap
+	cell [2]int
+}
+
+// Output points sorted together with their distances
+type byDistance struct {
+	points    []DataPoint
+	distances []float64
+}
+
+func (s byDistance) Len() int           { return len(s.points) }
+func (s byDistance) Less(i, j int) bool { return s.distances[i] < s.distances[j] }
+func (s byDistance) Swap(i, j int) {
+	s.points[i], s.points[j] = s.points[j], s.points[i]
+	s.distances[i], s.distances[j] = s.distances[j], s.distances[i]
 }
 
 type PQKNNPoints struct {
@@ -125,209 +141,204 @@ func CheckCachedCube(dTree *DTree, cachedCube []int, extendedData []float64) int
 }
 
 func (worker *Worker) KNNQuery(query *Query) ([]DataPoint, error) {
+	dataPoints, _, err := worker.ApproxKNNQuery(query)
+	return dataPoints, err
+}
+
+// Ratio of the distance of an output point to the lower bound of the unread cells
+func approxRatio(distance float64, lower float64) float64 {
+	if distance <= lower {
+		return 1
+	}
+	if lower == 0 {
+		return math.Inf(1)
+	}
+	return distance / lower
+}
+
+/*
+Return the K nearest points and the achieved error bound e: the i-th returned point is
+at most (1 + e) times as far as the true i-th nearest point, e is 0 for an exact answer
+and +Inf when nothing is known about the unread points.
+With query.Epsilon a point is output once no unread cell can be closer than its distance
+divided by (1 + Epsilon), and with query.MaxCells the search stops after that many cells
+and outputs the nearest points found so far
+*/
+func (worker *Worker) ApproxKNNQuery(query *Query) ([]DataPoint, float64, error) {
+	dataPoints, _, bound, err := worker.knnSearch(query)
+	return dataPoints, bound, err
+}
+
+// ApproxKNNQuery also returning the distance of each point
+func (worker *Worker) knnSearch(query *Query) ([]DataPoint, []float64, float64, error) {
 	centerData, err := query.ToDimFloatVal(worker.dTree)
 	//fmt.Println(centerData)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
+	}
+	if err := query.ValidatePredicate(); err != nil {
+		return nil, nil, 0, err
+	}
+	if query.Epsilon < 0 || query.MaxCells < 0 {
+		err := errors.New(fmt.Sprintf("KNN epsilon %f and cell budget %d must not be negative", query.Epsilon, query.MaxCells))
+		fmt.Println(err)
+		return nil, nil, 0, err
+	}
+	metric, err := query.DistanceMetric(worker.dTree.Dims)
+	if err != nil {
+		return nil, nil, 0, err
 	}
 	cubeInds, err := worker.dTree.EquatlitySearch(query.QueryDims, query.QueryDimVals)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
+	}
+	startMetaInd, err := worker.dTree.Nodes[cubeInds[0]].MapIndByVal(nil, centerData)
+	if err != nil {
+		return nil, nil, 0, err
 	}
-
-	cachedCube := make([]int, 1) // "cached" metaCube, aka dTreeNode
-	cachedCube[0] = cubeInds[0]
 
 	// Init data point heap
 	dataPointsPQ := new(PQKNNPoints)
 	dataPointsPQ.points = make([]*KNNPoint, 0)
 	heap.Init(dataPointsPQ)
 
-	// Init boundary point heap
-	boundaryPointsPQ := new(PQKNNPoints)
-	boundaryPointsPQ.points = make([]*KNNPoint, 0)
-	heap.Init(boundaryPointsPQ)
+	// Init cell heap, keyed by the lower bound of the distance to each cell
+	cellsPQ := new(PQKNNPoints)
+	cellsPQ.points = make([]*KNNPoint, 0)
+	heap.Init(cellsPQ)
 
 	// Init return data Points array
 	outputDataPoints := make([]DataPoint, 0)
+	outputDistances := make([]float64, 0)
+	maxRatio := float64(1)
+	output := func(dPoint *KNNPoint, lower float64) {
+		outputDataPoints = append(outputDataPoints, query.Project(dPoint.dPoint))
+		outputDistances = append(outputDistances, dPoint.distance)
+		maxRatio = math.Max(maxRatio, approxRatio(dPoint.distance, lower))
+	}
+	// Points output early with Epsilon are not in ascending order
+	result := func() ([]DataPoint, []float64, float64, error) {
+		if query.Epsilon > 0 {
+			sort.Stable(byDistance{outputDataPoints, outputDistances})
+		}
+		return outputDataPoints, outputDistances, maxRatio - 1, nil
+	}
 
-	// before beginning of loop, treat centerData as extension point
-	extendedData := centerData
+	/*
+		Best first search over the cells: every cell on the way from the center to the nearest
+		point of a cell is no farther than that point, so a cell is always found from a popped
+		neighbour before its turn, and once popped no unread cell can hold a closer point
+	*/
 	currentBoundDistance := float64(0)
 	currentDataDistance := float64(0)
-	metaCubeMap := make(map[[2]int]bool)
-	boundaryMap := make(map[string]bool)
+	cellNum := 0
+	decodeDims := query.decodeDims(worker.dTree.Dims)
+	visitedCells := map[[2]int]bool{{cubeInds[0], startMetaInd}: true}
+	// leaves of other workers read whole from their owners
+	fetchedCubes := make(map[int]bool)
+	push := func(dPoint *DataPoint) {
+		knnDp := new(KNNPoint)
+		knnDp.dPoint = dPoint
+		knnDp.distance = metric.Distance(centerData, dPoint.getFloatValsByDims(worker.dTree.Dims))
+		heap.Push(dataPointsPQ, knnDp)
+	}
+	heap.Push(cellsPQ, &KNNPoint{distance: 0, cell: [2]int{cubeInds[0], startMetaInd}})
 	for len(outputDataPoints) < query.K {
-		/*
-			fmt.Println("New Iteration /////////////")
-			forPrint := [2]float64{}
-			forPrint[0] = extendedData[0] - centerData[0]
-			forPrint[1] = extendedData[1] - centerData[1]
-			fmt.Println(forPrint)*/
-		extensionValid := true
-		cubeInd := CheckCachedCube(worker.dTree, cachedCube, extendedData)
-		currMetaInd := int(-1)
-		if cubeInd == -1 {
-			cubeInds, err = worker.dTree.EquatlitySearch(nil, extendedData)
-			if err != nil {
-				if cubeInds != nil && cubeInds[0] == -1 {
-					// Possible Non-error condition: extended Point is out of the DTree range
-					// Need to skip current extended Point
-					//fmt.Println("Extension Point out of range")
-					extensionValid = false
-				} else {
-					return nil, err
-				}
-			} else {
-				cubeInd = cubeInds[0]
-				cachedCube = append(cachedCube, cubeInd)
+		if cellsPQ.Len() == 0 {
+			// The whole tree has been searched, less than K (qualified) points exist
+			for dataPointsPQ.Len() > 0 && len(outputDataPoints) < query.K {
+				output(heap.Pop(dataPointsPQ).(*KNNPoint), math.Inf(1))
 			}
+			return result()
 		}
-		if cubeInd != -1 {
-			//fmt.Println(cubeInd)
-			currMetaInd, err = worker.dTree.Nodes[cubeInd].MapIndByVal(nil, extendedData)
-			if err != nil {
-				return nil, err
-			}
-			metaCell := [2]int{cubeInd, currMetaInd}
-			if _, exists := metaCubeMap[metaCell]; exists {
-				extensionValid = false
-			} else {
-				metaCubeMap[metaCell] = true
+		if query.MaxCells > 0 && cellNum >= query.MaxCells {
+			// Out of budget, the nearest unread cell bounds the error
+			for dataPointsPQ.Len() > 0 && len(outputDataPoints) < query.K {
+				output(heap.Pop(dataPointsPQ).(*KNNPoint), cellsPQ.points[0].distance)
 			}
+			return result()
 		}
 
-		if extensionValid {
-			metaIndList := make([]int, 1)
-			metaIndList[0] = currMetaInd
-
-			//fmt.Printf("Read data from MetaCube %d, CubeCell %d\n", cubeInd, currMetaInd)
-			//fmt.Println(metaCubeMap)
-			//Perform readBatch to force using cache, since ReadSingle doesn't cache metaCube
-			dataPoints := worker.db.ReadBatch(cubeInd, metaIndList)
-			for _, dp := range dataPoints {
-				knnDp := new(KNNPoint)
-				knnDp.dPoint = &dp
-				knnDp.distance = query.DistanceToCenter(knnDp.dPoint)
-				heap.Push(dataPointsPQ, knnDp)
-			}
-			// Push both corner and boundary points to Boundary heap
-			cornerPoints, err := worker.dTree.Nodes[cubeInd].Corners(currMetaInd)
-			if err != nil {
-				return nil, err
-			} else {
-				for _, cP := range cornerPoints {
-					// Prevent duplicate boundary point insertion (which will cause infinite loop)
-					// Hard code for 2D
-					boundKey := fmt.Sprintf("%s-%s", trunc2String(cP[0]), trunc2String(cP[1]))
-					if _, exists := boundaryMap[boundKey]; !exists {
-						knnBp := new(KNNPoint)
-						knnBp.vals = cP
-						knnBp.distance = PointDistance(centerData, cP)
-
-						if knnBp.distance < currentBoundDistance {
-							fmt.Println("A closer corner was proposed later")
-						}
-						//fmt.Println(cP)
-						//fmt.Println(boundaryMap)
-						/*
-							forPrint = [2]float64{}
-							forPrint[0] = cP[0] - centerData[0]
-							forPrint[1] = cP[1] - centerData[1]
-							fmt.Printf("%.15f,%.15f\n", forPrint[0], forPrint[1])
-						*/
-						//if knnBp.distance > currentDataDistance {
-						//}
-						heap.Push(boundaryPointsPQ, knnBp)
-						boundaryMap[boundKey] = true
-					}
-				}
-			}
-			boundaryPoints, err := worker.dTree.Nodes[cubeInd].BoundaryConstrain(centerData, currMetaInd)
-			if err != nil {
-				return nil, err
-			} else {
-				for _, cP := range boundaryPoints {
-					// Prevent duplicate boundary point insertion (which will cause infinite loop)
-					// Hard code for 2D
-					boundKey := fmt.Sprintf("%s-%s", trunc2String(cP[0]), trunc2String(cP[1]))
-					if _, exists := boundaryMap[boundKey]; !exists {
-						knnBp := new(KNNPoint)
-						knnBp.vals = cP
-						knnBp.distance = PointDistance(centerData, cP)
-
-						if knnBp.distance < currentBoundDistance {
-							fmt.Printf("A closer boundary was proposed later. cubeInd %d, meta%d \n", cubeInd, currMetaInd)
-							fmt.Println(cachedCube)
-							fmt.Println("boundary")
-							forPrint, forPrint2, _ := worker.dTree.Nodes[cubeInd].Boundary(currMetaInd)
-							forPrint[0] = forPrint[0] - centerData[0]
-							forPrint[1] = forPrint[1] - centerData[1]
-							forPrint2[0] = forPrint2[0] - centerData[0]
-							forPrint2[1] = forPrint2[1] - centerData[1]
-							fmt.Println(forPrint)
-							fmt.Println(forPrint2)
-							fmt.Println("end boundary")
-						}
-						/*
-							forPrint = [2]float64{}
-							forPrint[0] = cP[0] - centerData[0]
-							forPrint[1] = cP[1] - centerData[1]
-							fmt.Printf("%.15f,%.15f\n", forPrint[0], forPrint[1])
-						*/
-						heap.Push(boundaryPointsPQ, knnBp)
-						//if knnBp.distance > currentDataDistance {
-						//}
-						boundaryMap[boundKey] = true
-					}
-				}
-			}
+		botCell := heap.Pop(cellsPQ).(*KNNPoint)
+		if botCell.distance < currentBoundDistance {
+			err := errors.New(fmt.Sprintf("Cell Priority Queue not in ascending order, len %d", cellsPQ.Len()))
+			fmt.Println(err)
+			return nil, nil, 0, err
 		}
+		currentBoundDistance = botCell.distance
+		cellNum++
 
-		botBPoint := heap.Pop(boundaryPointsPQ).(*KNNPoint)
-
-		for dataPointsPQ.Len() > 0 {
-			// TODO: Need to dump redundant boundaryConstrains
-			// For example, the previous extended point is pushed back as well
-			// Need to analyze whether this condition will happen
+		// Every point no farther than the nearest unread cell, times 1 + Epsilon, is final
+		for dataPointsPQ.Len() > 0 && dataPointsPQ.points[0].distance <= botCell.distance*(1+query.Epsilon) {
 			botDPoint := heap.Pop(dataPointsPQ).(*KNNPoint)
-			// Check algorithm/implementation correctness, and track current max distance
-			if botDPoint.distance > botBPoint.distance {
-				// Then, current DPoint should be push back again since current data may not be nearest
-				heap.Push(dataPointsPQ, botDPoint)
-				// And break loop
-				break
-			}
-			if botDPoint.distance < currentDataDistance {
+			if query.Epsilon == 0 && botDPoint.distance < currentDataDistance {
 				err := errors.New(fmt.Sprintf("Data Priority Queue not in ascending order, len %d", dataPointsPQ.Len()))
 				fmt.Println(err)
-				return nil, err
-			} else {
-				currentBoundDistance = botDPoint.distance
+				return nil, nil, 0, err
 			}
-			outputDataPoints = append(outputDataPoints, *(botDPoint.dPoint))
+			currentDataDistance = botDPoint.distance
+			output(botDPoint, botCell.distance)
 			// immediately return if enough points are found
 			if len(outputDataPoints) == query.K {
-				return outputDataPoints, nil
+				return result()
 			}
 		}
 
-		if botBPoint.distance < currentBoundDistance {
-			err := errors.New(fmt.Sprintf("Boundary Priority Queue not in ascending order, len %d", boundaryPointsPQ.Len()))
-			fmt.Println(err)
-			return nil, err
-		} else {
-			currentBoundDistance = botBPoint.distance
+		cubeInd, currMetaInd := botCell.cell[0], botCell.cell[1]
+		lows, highs, err := worker.dTree.Nodes[cubeInd].Boundary(currMetaInd)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		// A cell whose box fails the filter is not read, but the search
+		// still goes through it
+		cellFilter := boxInside
+		if query.Predicate != nil {
+			cellFilter = query.Predicate.BoxCheck(worker.dTree.Dims, lows, highs)
+		}
+		if worker.cubeList[cubeInd] != worker.id {
+			// the MetaCube of the leaf is not stored here, its points enter the heap when its
+			// first cell is popped, and are only output once no unread cell is closer
+			if !fetchedCubes[cubeInd] {
+				fetchedCubes[cubeInd] = true
+				dataPoints := worker.getAll([]int{cubeInd}, decodeDims)
+				for i := range dataPoints {
+					if query.CheckPredicate(&dataPoints[i]) {
+						push(&dataPoints[i])
+					}
+				}
+			}
+		} else if cellFilter != boxOutside {
+			metaIndList := make([]int, 1)
+			metaIndList[0] = currMetaInd
+
+			//Perform readBatch to force using cache, since ReadSingle doesn't cache metaCube
+			dataPoints := worker.db.ReadBatchColumns(cubeInd, metaIndList, decodeDims)
+			for i := range dataPoints {
+				// Only qualified points enter the heap, so K qualified points are returned
+				if cellFilter == boxPartial && !query.CheckPredicate(&dataPoints[i]) {
+					continue
+				}
+				push(&dataPoints[i])
+			}
 		}
-		/*
-			forPrint = [2]float64{}
-			forPrint[0] = botBPoint.vals[0] - centerData[0]
-			forPrint[1] = botBPoint.vals[1] - centerData[1]
-			fmt.Println(forPrint)
-		*/
-		extendedData = PointExtension(centerData, botBPoint.vals)
-	}
 
-	return nil, nil
+		// Push the unvisited neighbour cells, in this and the adjacent nodes
+		neighbors, err := worker.dTree.NeighborCells(cubeInd, currMetaInd)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		for _, cell := range neighbors {
+			if visitedCells[cell] {
+				continue
+			}
+			visitedCells[cell] = true
+			cellMins, cellMaxs, _ := worker.dTree.Nodes[cell[0]].Boundary(cell[1])
+			distance := metric.LowerBound(centerData, cellMins, cellMaxs)
+			// an unvisited neighbour holds no point closer than the popped cell, see above
+			distance = math.Max(distance, botCell.distance)
+			heap.Push(cellsPQ, &KNNPoint{distance: distance, cell: cell})
+		}
+	}
 
+	return result()
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"testing"
+)
+
+// Trips with FArr = lat, lon, pickup time in epoch seconds
+func testPoints(n int) []DataPoint {
+	r := rand.New(rand.NewSource(1))
+	points := make([]DataPoint, n)
+	for i := range points {
+		points[i].FArr = []float64{40.6 + 0.3*r.Float64(), -74.1 + 0.3*r.Float64(), 1.44e9 + 1e7*r.Float64()}
+	}
+	return points
+}
+
+var (
+	testMins = []float64{40.6, -74.1, 1.44e9}
+	testMaxs = []float64{40.9, -73.8, 1.45e9}
+)
+
+// A worker owning every leaf of a tree on dims 0, 1, 2 holding points, cubes are stored in a temp dir
+func testWorker(t *testing.T, points []DataPoint) *Worker {
+	t.Chdir(t.TempDir())
+	dTree := InitTree([]uint{0, 1, 2}, []uint{4, 4, 4}, 2, testMins, testMaxs)
+	if err := dTree.UpdateTree(points); err != nil {
+		t.Fatal(err)
+	}
+	db, _ := InitDB()
+	for _, batch := range dTree.ToDataBatch() {
+		if err := db.Feed(&batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Worker{dTree: dTree, db: db, cubeList: map[int]int{}}
+}
+
+/*
+Workers 0 and 1 sharing a tree on dims 0, 1, 2 holding points, every other leaf is owned
+by worker 1 and stored only in its DB. Worker 0 reads the leaves of worker 1 through getAll,
+a listener on a local UDP port plays worker 1 and answers from its DB
+*/
+func testCluster(t *testing.T, points []DataPoint) (*Worker, *Worker) {
+	t.Chdir(t.TempDir())
+	dTree := InitTree([]uint{0, 1, 2}, []uint{4, 4, 4}, 2, testMins, testMaxs)
+	if err := dTree.UpdateTree(points); err != nil {
+		t.Fatal(err)
+	}
+	batches := dTree.ToDataBatch()
+	cubeList := make(map[int]int)
+	owner := 0
+	for _, batch := range batches {
+		cubeList[batch.CubeId] = owner
+		owner = 1 - owner
+	}
+	workers := make([]*Worker, 2)
+	for id := range workers {
+		db, _ := InitDBAt(fmt.Sprintf("./db%d/", id))
+		workers[id] = &Worker{id: id, dTree: dTree, db: db, cubeList: cubeList, peerChan: make(chan []byte)}
+	}
+	for _, batch := range batches {
+		if err := workers[cubeList[batch.CubeId]].db.Feed(&batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(workers[0].db.CubeMetaMap) == 0 || len(workers[1].db.CubeMetaMap) == 0 {
+		t.Fatal("expected leaves on both workers")
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	workers[0].peerList = map[int]peerInfo{
+		0: {id: 0, udpaddr: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+		1: {id: 1, udpaddr: *peer.LocalAddr().(*net.UDPAddr)},
+	}
+	go func() {
+		buf := make([]byte, 1<<16)
+		for {
+			n, _, err := peer.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var msg Message
+			json.Unmarshal(buf[:n], &msg)
+			var dPoints []DataPoint
+			for _, cubeInd := range msg.CubeIndex {
+				dPoints = append(dPoints, workers[1].db.ReadAllColumns(cubeInd, msg.Columns)...)
+			}
+			b, _ := json.Marshal(dPoints)
+			workers[0].peerChan <- b
+		}
+	}()
+	return workers[0], workers[1]
+}
+
+// KNN on a subset of the tree dims measures only the queried dims
+func TestKNNQueryDimsSubset(t *testing.T) {
+	points := testPoints(3000)
+	worker := testWorker(t, points)
+	for _, metric := range []int{0, 1, 2} {
+		query := InitQuery(2, []uint{0, 1}, []float64{40.75, -73.95}, nil, 5, "")
+		query.SetMetric(metric, nil)
+		result, err := worker.KNNQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		distances := make([]float64, len(points))
+		for i := range points {
+			distances[i] = query.DistanceToCenter(&points[i])
+		}
+		sort.Float64s(distances)
+		if len(result) != query.K {
+			t.Fatalf("metric %d: got %d points, want %d", metric, len(result), query.K)
+		}
+		for i := range result {
+			if d := query.DistanceToCenter(&result[i]); math.Abs(d-distances[i]) > 1e-9 {
+				t.Fatalf("metric %d: neighbour %d at distance %v, want %v", metric, i, d, distances[i])
+			}
+		}
+	}
+}
+
+// KNN on a worker reads the leaves of the other worker from it
+func TestKNNQueryRemoteLeaves(t *testing.T) {
+	points := testPoints(3000)
+	worker, _ := testCluster(t, points)
+	query := InitQuery(2, []uint{0, 1}, []float64{40.75, -73.95}, nil, 50, "")
+	result, err := worker.KNNQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	distances := make([]float64, len(points))
+	for i := range points {
+		distances[i] = query.DistanceToCenter(&points[i])
+	}
+	sort.Float64s(distances)
+	if len(result) != query.K {
+		t.Fatalf("got %d points, want %d", len(result), query.K)
+	}
+	for i := range result {
+		if d := query.DistanceToCenter(&result[i]); math.Abs(d-distances[i]) > 1e-9 {
+			t.Fatalf("neighbour %d at distance %v, want %v", i, d, distances[i])
+		}
+	}
+}
+
+func TestKNNQueryDimNotInTree(t *testing.T) {
+	worker := testWorker(t, testPoints(100))
+	query := InitQuery(2, []uint{0, 5}, []float64{40.75, 1}, nil, 5, "")
+	if _, err := worker.KNNQuery(query); err == nil {
+		t.Fatal("expected an error for a dim not in the tree")
+	}
+}
+
+// Radius on a subset of the tree dims keeps the points near the center on the queried dims only
+func TestRadiusQueryDimsSubset(t *testing.T) {
+	points := testPoints(3000)
+	worker := testWorker(t, points)
+	query := InitRadiusQuery([]uint{0, 1}, []float64{40.75, -73.95}, 0.05, 0, "")
+	result, _, err := worker.RadiusQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	for i := range points {
+		if query.DistanceToCenter(&points[i]) <= query.Radius {
+			want++
+		}
+	}
+	if want == 0 || len(result) != want {
+		t.Fatalf("got %d points, want %d", len(result), want)
+	}
+	for i := range result {
+		if d := query.DistanceToCenter(&result[i]); d > query.Radius {
+			t.Fatalf("point %v at distance %v outside radius %v", result[i].FArr, d, query.Radius)
+		}
+	}
+}
+
+// Radius on a worker reads the leaves of the other worker from it
+func TestRadiusQueryRemoteLeaves(t *testing.T) {
+	points := testPoints(3000)
+	worker, _ := testCluster(t, points)
+	query := InitRadiusQuery([]uint{0, 1}, []float64{40.75, -73.95}, 0.05, 0, "")
+	result, _, err := worker.RadiusQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	for i := range points {
+		if query.DistanceToCenter(&points[i]) <= query.Radius {
+			want++
+		}
+	}
+	if want == 0 || len(result) != want {
+		t.Fatalf("got %d points, want %d", len(result), want)
+	}
+}
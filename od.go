@@ -0,0 +1,155 @@
+package main
+
+/*
+ODFlow counts the trips from every origin region to every destination region,
+Counts[i][j] is the number of trips starting in Origins[i] and ending in Destinations[j]
+A trip in overlapping regions is counted once for each pair
+*/
+type ODFlow struct {
+	Counts [][]int
+}
+
+func InitODFlow(originNum int, destNum int) *ODFlow {
+	flow := new(ODFlow)
+	flow.Counts = make([][]int, originNum)
+	for i := range flow.Counts {
+		flow.Counts[i] = make([]int, destNum)
+	}
+	return flow
+}
+
+func (flow *ODFlow) Merge(other *ODFlow) {
+	for i := range other.Counts {
+		if i >= len(flow.Counts) {
+			break
+		}
+		for j, c := range other.Counts[i] {
+			if j < len(flow.Counts[i]) {
+				flow.Counts[i][j] += c
+			}
+		}
+	}
+}
+
+// Relation of the box on dims with every region on the xy dims,
+// boxPartial for all regions when the box is not on the xy dims
+func regionRelations(regions []*Polygon, xyDims []uint, dims []uint, mins []float64, maxs []float64) []int {
+	relations := make([]int, len(regions))
+	xInd, yInd := -1, -1
+	for i, d := range dims {
+		if d == xyDims[0] {
+			xInd = i
+		}
+		if d == xyDims[1] {
+			yInd = i
+		}
+	}
+	for i, region := range regions {
+		relations[i] = boxPartial
+		if xInd >= 0 && yInd >= 0 {
+			relations[i] = region.BoxRelation(mins[xInd], mins[yInd], maxs[xInd], maxs[yInd])
+		}
+	}
+	return relations
+}
+
+// Indices of the regions containing the point on the xy dims
+func containingRegions(regions []*Polygon, xyDims []uint, dPoint *DataPoint) []int {
+	var inds []int
+	x, y := dPoint.getFloatValByDim(xyDims[0]), dPoint.getFloatValByDim(xyDims[1])
+	for i, region := range regions {
+		if region.Contains(x, y) {
+			inds = append(inds, i)
+		}
+	}
+	return inds
+}
+
+// Summary of relations: boxOutside if all are outside, boxInside if none is partial
+func combineRelations(relations []int) int {
+	result := boxOutside
+	for _, r := range relations {
+		if r == boxPartial {
+			return boxPartial
+		} else if r == boxInside {
+			result = boxInside
+		}
+	}
+	return result
+}
+
+/*
+Return the trips starting in any origin region and ending in any destination region,
+and the flow counts between the regions, on the cubes owned by this worker
+Both endpoints prune the tree and the cells whenever they are dims of the tree, so a tree
+on one endpoint filters the other endpoint by point, and a 4D tree prunes both.
+For QueryType = 8 only the flows are needed, cells fully inside or outside every region
+are then counted from CubeCell.Count
+*/
+func (worker *Worker) ODQuery(query *Query) ([]DataPoint, *ODFlow, error) {
+	if err := query.ValidateOD(); err != nil {
+		return nil, nil, err
+	}
+	cubeInds, err := worker.dTree.PredicateSearch(query.odPredicate())
+	if err != nil {
+		return nil, nil, err
+	}
+	flowOnly := query.QueryType == 8
+	flow := InitODFlow(len(query.Origins), len(query.Destinations))
+	var dataPoints []DataPoint
+	decodeDims := query.decodeDims(query.OriginDims, query.DestDims)
+	for _, cubeInd := range cubeInds {
+		if worker.cubeList[cubeInd] != worker.id {
+			continue
+		}
+		node := &worker.dTree.Nodes[cubeInd]
+		var metaInds []int
+		for metaInd := 0; metaInd < int(node.Capacity); metaInd++ {
+			cellMins, cellMaxs, _ := node.Boundary(metaInd)
+			originRels := regionRelations(query.Origins, query.OriginDims, node.Dims, cellMins, cellMaxs)
+			destRels := regionRelations(query.Destinations, query.DestDims, node.Dims, cellMins, cellMaxs)
+			originRel, destRel := combineRelations(originRels), combineRelations(destRels)
+			predRel := boxInside
+			if query.Predicate != nil {
+				predRel = query.Predicate.BoxCheck(node.Dims, cellMins, cellMaxs)
+			}
+			if originRel == boxOutside || destRel == boxOutside || predRel == boxOutside {
+				continue
+			}
+			if !flowOnly || originRel == boxPartial || destRel == boxPartial || predRel == boxPartial {
+				metaInds = append(metaInds, metaInd)
+				continue
+			}
+			count := worker.db.CellCount(cubeInd, metaInd)
+			for i, originRel := range originRels {
+				for j, destRel := range destRels {
+					if originRel == boxInside && destRel == boxInside {
+						flow.Counts[i][j] += count
+					}
+				}
+			}
+		}
+		if len(metaInds) == 0 {
+			continue
+		}
+		for _, dp := range worker.db.ReadBatchColumns(cubeInd, metaInds, decodeDims) {
+			if !query.CheckPredicate(&dp) {
+				continue
+			}
+			originInds := containingRegions(query.Origins, query.OriginDims, &dp)
+			destInds := containingRegions(query.Destinations, query.DestDims, &dp)
+			if len(originInds) == 0 || len(destInds) == 0 {
+				continue
+			}
+			for _, i := range originInds {
+				for _, j := range destInds {
+					flow.Counts[i][j]++
+				}
+			}
+			if !flowOnly {
+				dataPoints = append(dataPoints, query.Project(&dp))
+			}
+		}
+	}
+	return dataPoints, flow, nil
+}
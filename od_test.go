@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Each worker counts the trips of its own leaves only, together they count every trip once
+func TestODQueryOwnedLeaves(t *testing.T) {
+	points := testPoints(3000)
+	r := rand.New(rand.NewSource(2))
+	for i := range points {
+		// drop off lat, lon
+		points[i].FArr = append(points[i].FArr, 40.6+0.3*r.Float64(), -74.1+0.3*r.Float64())
+	}
+	worker0, worker1 := testCluster(t, points)
+	origins := []*Polygon{BoxPolygon(40.65, -74.05, 40.75, -73.95), BoxPolygon(40.7, -74.0, 40.85, -73.85)}
+	dests := []*Polygon{BoxPolygon(40.6, -74.1, 40.8, -73.9)}
+	query, err := InitODQuery(7, []uint{0, 1}, origins, []uint{3, 4}, dests, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InitODFlow(len(origins), len(dests))
+	wantTrips := 0
+	for i := range points {
+		originInds := containingRegions(origins, query.OriginDims, &points[i])
+		destInds := containingRegions(dests, query.DestDims, &points[i])
+		if len(originInds) > 0 && len(destInds) > 0 {
+			wantTrips++
+		}
+		for _, o := range originInds {
+			for _, d := range destInds {
+				want.Counts[o][d]++
+			}
+		}
+	}
+	got := InitODFlow(len(origins), len(dests))
+	gotTrips := 0
+	for _, worker := range []*Worker{worker0, worker1} {
+		trips, flow, err := worker.ODQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trips) == 0 || len(trips) == wantTrips {
+			t.Fatalf("worker %d got %d of %d trips, want the trips of its own leaves", worker.id, len(trips), wantTrips)
+		}
+		gotTrips += len(trips)
+		for o := range flow.Counts {
+			for d := range flow.Counts[o] {
+				got.Counts[o][d] += flow.Counts[o][d]
+			}
+		}
+	}
+	if gotTrips != wantTrips {
+		t.Fatalf("got %d trips, want %d", gotTrips, wantTrips)
+	}
+	if !reflect.DeepEqual(got.Counts, want.Counts) {
+		t.Fatalf("got flows %v, want %v", got.Counts, want.Counts)
+	}
+}
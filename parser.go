@@ -0,0 +1,533 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Schema names the dims of the points, numbered as in Predicate: the float columns
+(FArr) first, then the int columns (IArr), then the string columns (SArr)
+Spatial are the default dims of NEAREST and WITHIN
+*/
+type Schema struct {
+	Dims    map[string]uint
+	Kinds   map[string]int
+	Spatial []string
+}
+
+func InitSchema(floats []string, ints []string, strs []string, spatial []string) *Schema {
+	schema := &Schema{Dims: make(map[string]uint), Kinds: make(map[string]int)}
+	for kind, names := range [][]string{floats, ints, strs} {
+		for _, name := range names {
+			schema.Dims[name] = uint(len(schema.Dims))
+			schema.Kinds[name] = kind
+		}
+	}
+	schema.Spatial = make([]string, len(spatial))
+	copy(schema.Spatial, spatial)
+	return schema
+}
+
+// Dim and kind (0 float, 1 int, 2 string) of the column
+func (schema *Schema) Dim(name string) (uint, int, error) {
+	dim, exists := schema.Dims[name]
+	if !exists {
+		err := errors.New(fmt.Sprintf("Unknown column %s", name))
+		fmt.Println(err)
+		return 0, -1, err
+	}
+	return dim, schema.Kinds[name], nil
+}
+
+// Token kinds of the query language
+const (
+	tokEOF = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokSymbol
+)
+
+type token struct {
+	kind int
+	text string
+	num  float64
+}
+
+var tokenRegex = regexp.MustCompile(`^(?:(\s+)|([A-Za-z_][A-Za-z0-9_]*)|((?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?)|'((?:[^']|'')*)'|(<=|>=|<>|!=|[-=<>(),*]))`)
+
+// Split the query text into tokens
+func lexQuery(text string) ([]token, error) {
+	var tokens []token
+	for rest := text; len(rest) > 0; {
+		m := tokenRegex.FindStringSubmatch(rest)
+		if m == nil {
+			err := errors.New(fmt.Sprintf("Unexpected character at %q", rest))
+			fmt.Println(err)
+			return nil, err
+		}
+		rest = rest[len(m[0]):]
+		switch {
+		case m[1] != "":
+		case m[2] != "":
+			tokens = append(tokens, token{kind: tokIdent, text: m[2]})
+		case m[3] != "":
+			num, _ := strconv.ParseFloat(m[3], 64)
+			tokens = append(tokens, token{kind: tokNumber, text: m[3], num: num})
+		case m[5] != "":
+			tokens = append(tokens, token{kind: tokSymbol, text: m[5]})
+		default:
+			tokens = append(tokens, token{kind: tokString, text: strings.Replace(m[4], "''", "'", -1)})
+		}
+	}
+	return append(tokens, token{kind: tokEOF}), nil
+}
+
+type queryParser struct {
+	tokens []token
+	pos    int
+	schema *Schema
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	err := errors.New(fmt.Sprintf(format, args...))
+	fmt.Println(err)
+	return err
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// Consume the keyword if it is next, keywords are case insensitive
+func (p *queryParser) keyword(kw string) bool {
+	if tok := p.peek(); tok.kind == tokIdent && strings.EqualFold(tok.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expectKeyword(kw string) error {
+	if !p.keyword(kw) {
+		return p.errorf("Expected %s, got %q", kw, p.peek().text)
+	}
+	return nil
+}
+
+// Consume the symbol if it is next
+func (p *queryParser) symbol(sym string) bool {
+	if tok := p.peek(); tok.kind == tokSymbol && tok.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expectSymbol(sym string) error {
+	if !p.symbol(sym) {
+		return p.errorf("Expected %s, got %q", sym, p.peek().text)
+	}
+	return nil
+}
+
+func (p *queryParser) number() (float64, error) {
+	sign := float64(1)
+	if p.symbol("-") {
+		sign = -1
+	}
+	tok := p.next()
+	if tok.kind != tokNumber {
+		return 0, p.errorf("Expected a number, got %q", tok.text)
+	}
+	return sign * tok.num, nil
+}
+
+func (p *queryParser) integer() (int, error) {
+	tok := p.next()
+	n, err := strconv.Atoi(tok.text)
+	if tok.kind != tokNumber || err != nil {
+		return 0, p.errorf("Expected an integer, got %q", tok.text)
+	}
+	return n, nil
+}
+
+func (p *queryParser) column() (uint, int, error) {
+	tok := p.next()
+	if tok.kind != tokIdent {
+		return 0, -1, p.errorf("Expected a column, got %q", tok.text)
+	}
+	return p.schema.Dim(tok.text)
+}
+
+// '(' item {',' item} ')'
+func (p *queryParser) list(item func() error) error {
+	if err := p.expectSymbol("("); err != nil {
+		return err
+	}
+	for {
+		if err := item(); err != nil {
+			return err
+		}
+		if !p.symbol(",") {
+			return p.expectSymbol(")")
+		}
+	}
+}
+
+func (p *queryParser) numberList() ([]float64, error) {
+	var vals []float64
+	err := p.list(func() error {
+		v, err := p.number()
+		vals = append(vals, v)
+		return err
+	})
+	return vals, err
+}
+
+func (p *queryParser) columnList() ([]uint, error) {
+	var dims []uint
+	err := p.list(func() error {
+		d, _, err := p.column()
+		dims = append(dims, d)
+		return err
+	})
+	return dims, err
+}
+
+// A literal compared with a column of the kind, strings on numeric columns are timestamps
+func (p *queryParser) literal(kind int) (float64, string, error) {
+	if tok := p.peek(); tok.kind == tokString {
+		p.pos++
+		if kind == 2 {
+			return 0, tok.text, nil
+		}
+		v, err := ParseTimestamp(tok.text)
+		if err != nil {
+			return 0, "", p.errorf("Expected a number or a timestamp, got %q", tok.text)
+		}
+		return v, "", nil
+	}
+	if kind == 2 {
+		return 0, "", p.errorf("Expected a string, got %q", p.peek().text)
+	}
+	v, err := p.number()
+	return v, "", err
+}
+
+// Comparison of the dim with the literals
+func (p *queryParser) comparison(op int, dim uint, kind int, n int) (*Predicate, error) {
+	pred := &Predicate{Op: op, Dim: dim}
+	for i := 0; i < n; i++ {
+		if i > 0 && op == predBetween {
+			if err := p.expectKeyword("and"); err != nil {
+				return nil, err
+			}
+		}
+		v, s, err := p.literal(kind)
+		if err != nil {
+			return nil, err
+		}
+		if kind == 2 {
+			pred.StrVals = append(pred.StrVals, s)
+		} else {
+			pred.Vals = append(pred.Vals, v)
+		}
+	}
+	return pred, nil
+}
+
+var cmpOps = map[string]int{"=": predEq, "!=": predNe, "<>": predNe, "<": predLt, "<=": predLe, ">": predGt, ">=": predGe}
+
+// or := and {OR and}
+func (p *queryParser) parseOr() (*Predicate, error) {
+	pred, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		pred = OrPredicate(pred, right)
+	}
+	return pred, nil
+}
+
+// and := not {AND not}
+func (p *queryParser) parseAnd() (*Predicate, error) {
+	pred, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		pred = AndPredicate(pred, right)
+	}
+	return pred, nil
+}
+
+// not := NOT not | '(' or ')' | col BETWEEN lit AND lit | col [NOT] IN (lit, ...) | col [NOT] LIKE 'pattern' | col op lit
+func (p *queryParser) parseNot() (*Predicate, error) {
+	if p.keyword("not") {
+		pred, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return NotPredicate(pred), nil
+	}
+	if p.symbol("(") {
+		pred, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return pred, p.expectSymbol(")")
+	}
+	dim, kind, err := p.column()
+	if err != nil {
+		return nil, err
+	}
+	if p.keyword("between") {
+		return p.comparison(predBetween, dim, kind, 2)
+	}
+	negate := p.keyword("not")
+	var pred *Predicate
+	if p.keyword("in") {
+		pred = &Predicate{Op: predIn, Dim: dim}
+		err = p.list(func() error {
+			v, s, err := p.literal(kind)
+			if kind == 2 {
+				pred.StrVals = append(pred.StrVals, s)
+			} else {
+				pred.Vals = append(pred.Vals, v)
+			}
+			return err
+		})
+	} else if p.keyword("like") {
+		tok := p.next()
+		if tok.kind != tokString || kind != 2 {
+			return nil, p.errorf("LIKE requires a string column and a pattern, got %q", tok.text)
+		}
+		// % matches any run of characters and _ any single character
+		pattern := regexp.QuoteMeta(tok.text)
+		pattern = strings.Replace(strings.Replace(pattern, "%", ".*", -1), "_", ".", -1)
+		pred = StrPredicate(predRegex, dim, "^"+pattern+"$")
+	} else if negate {
+		return nil, p.errorf("Expected IN or LIKE after NOT, got %q", p.peek().text)
+	} else if op, exists := cmpOps[p.peek().text]; exists && p.peek().kind == tokSymbol {
+		p.pos++
+		pred, err = p.comparison(op, dim, kind, 1)
+	} else {
+		return nil, p.errorf("Expected a comparison after column, got %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if negate {
+		pred = NotPredicate(pred)
+	}
+	return pred, nil
+}
+
+var aggNames = map[string]int{"count": aggCount, "sum": aggSum, "avg": aggAvg, "min": aggMin, "max": aggMax}
+
+var metricNames = map[string]int{"euclidean": 0, "haversine": 1, "manhattan": 2}
+
+/*
+ParseQuery turns a statement of the query language into a Query, column names are
+resolved through the schema, keywords are case insensitive
+
+	[EXPLAIN [ANALYZE]]
+	SELECT * | col, ... | COUNT(*) | SUM(col) | AVG(col) | MIN(col) | MAX(col)
+	[WHERE cond]
+	[NEAREST k TO (v, ...) | WITHIN r OF (v, ...)] [ON (col, ...)] [USING EUCLIDEAN | HAVERSINE | MANHATTAN]
+	[ORDER BY col [ASC | DESC]]
+	[LIMIT n]
+
+cond combines col op lit (=, !=, <>, <, <=, >, >=), col BETWEEN lit AND lit,
+col [NOT] IN (lit, ...) and col [NOT] LIKE 'pattern' with AND, OR, NOT and parentheses,
+a string literal on a numeric column is a timestamp in timeLayout
+NEAREST is a KNN query and WITHIN a radius query around the center, on the ON dims or
+schema.Spatial, the WHERE condition filters their points. Without them the WHERE condition
+is the region of a range query, an aggregate over it, or with ORDER BY and LIMIT a top-N.
+LIMIT caps K of NEAREST, and the number of points of a range query
+EXPLAIN returns the plan of an equality or range query, ANALYZE also executes it
+*/
+func ParseQuery(text string, schema *Schema, client string) (*Query, error) {
+	tokens, err := lexQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens, schema: schema}
+	explain := p.keyword("explain")
+	analyze := explain && p.keyword("analyze")
+	if err := p.expectKeyword("select"); err != nil {
+		return nil, err
+	}
+
+	// projection or aggregate
+	var columns []uint
+	aggFunc, aggDim := -1, uint(0)
+	if p.symbol("*") {
+		// whole points
+	} else if f, exists := aggNames[strings.ToLower(p.peek().text)]; exists && p.tokens[p.pos+1].text == "(" {
+		p.pos += 2
+		aggFunc = f
+		if f != aggCount || !p.symbol("*") {
+			dim, kind, err := p.column()
+			if err != nil {
+				return nil, err
+			}
+			if kind != 0 {
+				return nil, p.errorf("Aggregate requires a float column")
+			}
+			aggDim = dim
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+	} else {
+		for {
+			dim, _, err := p.column()
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, dim)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+
+	q := InitQuery(1, nil, nil, nil, 0, client)
+	if p.keyword("where") {
+		if q.Predicate, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+
+	// knn or radius around a center
+	var center []float64
+	if p.keyword("nearest") {
+		if q.K, err = p.integer(); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("to"); err != nil {
+			return nil, err
+		}
+		q.QueryType = 2
+	} else if p.keyword("within") {
+		if q.Radius, err = p.number(); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("of"); err != nil {
+			return nil, err
+		}
+		q.QueryType = 3
+	}
+	if q.QueryType != 1 {
+		if center, err = p.numberList(); err != nil {
+			return nil, err
+		}
+		dims := make([]uint, 0)
+		if p.keyword("on") {
+			if dims, err = p.columnList(); err != nil {
+				return nil, err
+			}
+		} else {
+			for _, name := range schema.Spatial {
+				dim, _, err := schema.Dim(name)
+				if err != nil {
+					return nil, err
+				}
+				dims = append(dims, dim)
+			}
+		}
+		if len(dims) != len(center) {
+			return nil, p.errorf("Center has %d values, got %d dims", len(center), len(dims))
+		}
+		q.QueryDims, q.QueryDimVals = dims, center
+		if p.keyword("using") {
+			metric, exists := metricNames[strings.ToLower(p.peek().text)]
+			if !exists {
+				return nil, p.errorf("Unknown metric %q", p.peek().text)
+			}
+			p.pos++
+			q.Metric = metric
+		}
+	}
+
+	orderBy, orderDim, descending := false, uint(0), false
+	if p.keyword("order") {
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		dim, kind, err := p.column()
+		if err != nil {
+			return nil, err
+		}
+		if kind != 0 {
+			return nil, p.errorf("ORDER BY requires a float column")
+		}
+		orderBy, orderDim = true, dim
+		descending = p.keyword("desc")
+		if !descending {
+			p.keyword("asc")
+		}
+	}
+	limit := 0
+	if p.keyword("limit") {
+		if limit, err = p.integer(); err != nil {
+			return nil, err
+		}
+		if limit <= 0 {
+			return nil, p.errorf("LIMIT requires a positive integer, got %d", limit)
+		}
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf("Unexpected %q at the end of the query", tok.text)
+	}
+
+	switch {
+	case aggFunc >= 0 && (q.QueryType != 1 || orderBy || limit > 0):
+		return nil, p.errorf("Aggregates do not support NEAREST, WITHIN, ORDER BY or LIMIT")
+	case aggFunc >= 0:
+		q.SetAggregate(aggFunc, aggDim)
+	case orderBy && (q.QueryType != 1 || limit == 0):
+		return nil, p.errorf("ORDER BY requires LIMIT and no NEAREST or WITHIN")
+	case orderBy:
+		q.SetTopN(limit, orderDim, descending)
+	case q.QueryType == 3 && limit > 0:
+		return nil, p.errorf("WITHIN does not support LIMIT")
+	case q.QueryType == 2 && limit > 0 && limit < q.K:
+		q.K = limit
+	case q.QueryType == 1 && limit > 0:
+		q.SetLimit(limit)
+	}
+	if len(columns) > 0 {
+		q.SetProjection(columns)
+	}
+	if explain {
+		q.SetExplain(analyze)
+	}
+	if err := q.ValidatePredicate(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
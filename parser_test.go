@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// NEAREST and WITHIN without ON default to the dims of the client tree
+func TestParseSpatialTreeDims(t *testing.T) {
+	q, err := ParseQuery("SELECT * NEAREST 5 TO (40.75, -73.95)", ImportSchema(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint{1, 0}; !reflect.DeepEqual(q.QueryDims, want) {
+		t.Fatalf("got dims %v, want %v", q.QueryDims, want)
+	}
+}
+
+// LIMIT caps the whole result of a range query instead of paging it
+func TestParseRangeLimit(t *testing.T) {
+	worker := testWorker(t, testPoints(1000))
+	schema := InitSchema([]string{"lat", "lon", "ts"}, nil, nil, []string{"lat", "lon"})
+	q, err := ParseQuery("SELECT * WHERE lat > 40.7 LIMIT 10", schema, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.PageSize != 0 || q.Limit != 10 {
+		t.Fatalf("got page size %d and limit %d, want 0 and 10", q.PageSize, q.Limit)
+	}
+	result, _, err := worker.RangeQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != q.Limit {
+		t.Fatalf("got %d points, want %d", len(result), q.Limit)
+	}
+	for _, dp := range result {
+		if dp.FArr[0] <= 40.7 {
+			t.Fatalf("point %v outside the range", dp.FArr)
+		}
+	}
+	batch := worker.BatchQuery([]*Query{q})
+	if batch[0].Error != "" || len(batch[0].Points) != q.Limit {
+		t.Fatalf("got %d points in batch, want %d", len(batch[0].Points), q.Limit)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// Relation between a box and a polygon
+	boxOutside = 0
+	boxPartial = 1
+	boxInside  = 2
+)
+
+// Simple polygon given by its vertices, each vertex is an (x, y) pair
+// The last vertex is implicitly connected back to the first one
+type Polygon struct {
+	Vertices [][]float64
+}
+
+func InitPolygon(vertices [][]float64) (*Polygon, error) {
+	if len(vertices) < 3 {
+		err := errors.New(fmt.Sprintf("Polygon requires at least 3 vertices, got %d", len(vertices)))
+		fmt.Println(err)
+		return nil, err
+	}
+	poly := new(Polygon)
+	poly.Vertices = make([][]float64, len(vertices))
+	for i, v := range vertices {
+		if len(v) != 2 {
+			err := errors.New(fmt.Sprintf("Polygon vertex %d has %d values, requires 2", i, len(v)))
+			fmt.Println(err)
+			return nil, err
+		}
+		poly.Vertices[i] = []float64{v[0], v[1]}
+	}
+	return poly, nil
+}
+
+// Rectangle [xmin, xmax] x [ymin, ymax] as a polygon
+func BoxPolygon(xmin, ymin, xmax, ymax float64) *Polygon {
+	return &Polygon{Vertices: [][]float64{{xmin, ymin}, {xmax, ymin}, {xmax, ymax}, {xmin, ymax}}}
+}
+
+// Bounding box of the polygon
+func (poly *Polygon) Bounds() (xmin, ymin, xmax, ymax float64) {
+	xmin, ymin = math.Inf(1), math.Inf(1)
+	xmax, ymax = math.Inf(-1), math.Inf(-1)
+	for _, v := range poly.Vertices {
+		xmin, xmax = math.Min(xmin, v[0]), math.Max(xmax, v[0])
+		ymin, ymax = math.Min(ymin, v[1]), math.Max(ymax, v[1])
+	}
+	return
+}
+
+// Even-odd ray casting
+func (poly *Polygon) Contains(x, y float64) bool {
+	inside := false
+	n := len(poly.Vertices)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		xi, yi := poly.Vertices[i][0], poly.Vertices[i][1]
+		xj, yj := poly.Vertices[j][0], poly.Vertices[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Liang-Barsky clipping of segment (x1, y1)-(x2, y2) against the box
+func segmentIntersectsBox(x1, y1, x2, y2, xmin, ymin, xmax, ymax float64) bool {
+	t0, t1 := 0., 1.
+	dx, dy := x2-x1, y2-y1
+	p := []float64{-dx, dx, -dy, dy}
+	q := []float64{x1 - xmin, xmax - x1, y1 - ymin, ymax - y1}
+	for i := range p {
+		if p[i] == 0 {
+			if q[i] < 0 {
+				return false
+			}
+			continue
+		}
+		t := q[i] / p[i]
+		if p[i] < 0 {
+			t0 = math.Max(t0, t)
+		} else {
+			t1 = math.Min(t1, t)
+		}
+		if t0 > t1 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Classify the box as boxOutside, boxPartial or boxInside the polygon
+When no edge crosses the box, the whole box is on the same side as its center
+*/
+func (poly *Polygon) BoxRelation(xmin, ymin, xmax, ymax float64) int {
+	pxmin, pymin, pxmax, pymax := poly.Bounds()
+	if xmax < pxmin || xmin > pxmax || ymax < pymin || ymin > pymax {
+		return boxOutside
+	}
+	n := len(poly.Vertices)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		if segmentIntersectsBox(poly.Vertices[j][0], poly.Vertices[j][1], poly.Vertices[i][0], poly.Vertices[i][1],
+			xmin, ymin, xmax, ymax) {
+			return boxPartial
+		}
+	}
+	if poly.Contains((xmin+xmax)/2, (ymin+ymax)/2) {
+		return boxInside
+	}
+	return boxOutside
+}
+
+// Positions of the polygon x and y dims in dims
+func polygonDimInds(dims []uint, xDim uint, yDim uint) (int, int, error) {
+	xInd, yInd := -1, -1
+	for i, d := range dims {
+		if d == xDim {
+			xInd = i
+		}
+		if d == yDim {
+			yInd = i
+		}
+	}
+	if xInd < 0 || yInd < 0 {
+		err := errors.New(fmt.Sprintf("Dimension %d or %d not exist in data", xDim, yDim))
+		fmt.Println(err)
+		return -1, -1, err
+	}
+	return xInd, yInd, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+// Polygon on a worker reads the leaves of the other worker from it
+func TestPolygonQueryRemoteLeaves(t *testing.T) {
+	points := testPoints(3000)
+	worker, _ := testCluster(t, points)
+	query, err := InitPolygonQuery([]uint{0, 1}, [][]float64{{40.65, -74.05}, {40.85, -74.0}, {40.75, -73.85}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _, err := worker.PolygonQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	for i := range points {
+		if query.Polygon.Contains(points[i].FArr[0], points[i].FArr[1]) {
+			want++
+		}
+	}
+	if want == 0 || len(result) != want {
+		t.Fatalf("got %d points, want %d", len(result), want)
+	}
+}
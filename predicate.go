@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Predicate operations
+const (
+	predAnd = iota
+	predOr
+	predNot
+	predEq
+	predNe
+	predLt
+	predLe
+	predGt
+	predGe
+	// Inclusive on both ends
+	predBetween
+	predIn
+	// String only
+	predPrefix
+	predRegex
+)
+
+/*
+Predicate is a boolean expression tree over the dims of DataPoint
+Logical nodes (and, or, not) only use Children, comparison nodes
+compare the value of Dim with Vals, or with StrVals when Dim is a string
+Dims follow getFloatValByDim, getIntValByDim and getStringValByDim:
+FArr first, then IArr, then SArr
+*/
+type Predicate struct {
+	Op       int
+	Dim      uint
+	Vals     []float64
+	StrVals  []string
+	Children []*Predicate
+
+	regex *regexp.Regexp
+}
+
+func InitPredicate(op int, dim uint, vals []float64, children []*Predicate) (*Predicate, error) {
+	pred := new(Predicate)
+	pred.Op = op
+	pred.Dim = dim
+	pred.Vals = make([]float64, len(vals))
+	copy(pred.Vals, vals)
+	pred.Children = make([]*Predicate, len(children))
+	copy(pred.Children, children)
+	if err := pred.Validate(); err != nil {
+		return nil, err
+	}
+	return pred, nil
+}
+
+func AndPredicate(children ...*Predicate) *Predicate {
+	return &Predicate{Op: predAnd, Children: children}
+}
+
+func OrPredicate(children ...*Predicate) *Predicate {
+	return &Predicate{Op: predOr, Children: children}
+}
+
+func NotPredicate(child *Predicate) *Predicate {
+	return &Predicate{Op: predNot, Children: []*Predicate{child}}
+}
+
+// Comparison of dim with vals, op is one of predEq to predIn
+func CmpPredicate(op int, dim uint, vals ...float64) *Predicate {
+	return &Predicate{Op: op, Dim: dim, Vals: vals}
+}
+
+// Comparison of string dim with vals, op is one of predEq to predRegex
+func StrPredicate(op int, dim uint, vals ...string) *Predicate {
+	return &Predicate{Op: op, Dim: dim, StrVals: vals}
+}
+
+// Time window [from, to) on a timestamp dim, from and to in timeLayout
+func TimeWindowPredicate(dim uint, from string, to string) (*Predicate, error) {
+	fromVal, err := ParseTimestamp(from)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	toVal, err := ParseTimestamp(to)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return AndPredicate(CmpPredicate(predGe, dim, fromVal), CmpPredicate(predLt, dim, toVal)), nil
+}
+
+// Number of values the predicate compares with
+func (pred *Predicate) valNum() int {
+	if len(pred.StrVals) > 0 {
+		return len(pred.StrVals)
+	}
+	return len(pred.Vals)
+}
+
+// Check the arity of every node in the tree, and compile the regular expressions
+func (pred *Predicate) Validate() error {
+	var err error
+	if len(pred.Vals) > 0 && len(pred.StrVals) > 0 {
+		err = errors.New(fmt.Sprintf("Predicate op %d has both float and string values", pred.Op))
+		fmt.Println(err)
+		return err
+	}
+	switch pred.Op {
+	case predAnd, predOr:
+		// empty and is true, empty or is false
+	case predNot:
+		if len(pred.Children) != 1 {
+			err = errors.New(fmt.Sprintf("Predicate not requires 1 child, got %d", len(pred.Children)))
+		}
+	case predEq, predNe, predLt, predLe, predGt, predGe:
+		if pred.valNum() != 1 {
+			err = errors.New(fmt.Sprintf("Predicate op %d requires 1 value, got %d", pred.Op, pred.valNum()))
+		}
+	case predBetween:
+		if pred.valNum() != 2 {
+			err = errors.New(fmt.Sprintf("Predicate between requires 2 values, got %d", pred.valNum()))
+		}
+	case predIn:
+		if pred.valNum() == 0 {
+			err = errors.New("Predicate in requires values")
+		}
+	case predPrefix:
+		if len(pred.StrVals) != 1 {
+			err = errors.New(fmt.Sprintf("Predicate prefix requires 1 string, got %d", len(pred.StrVals)))
+		}
+	case predRegex:
+		if len(pred.StrVals) != 1 {
+			err = errors.New(fmt.Sprintf("Predicate regex requires 1 string, got %d", len(pred.StrVals)))
+		} else if pred.regex == nil {
+			pred.regex, err = regexp.Compile(pred.StrVals[0])
+		}
+	default:
+		err = errors.New(fmt.Sprintf("Unknown predicate op %d", pred.Op))
+	}
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	for _, child := range pred.Children {
+		if err = child.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dims compared anywhere in the tree
+func (pred *Predicate) dims() []uint {
+	if pred.Op == predAnd || pred.Op == predOr || pred.Op == predNot {
+		var dims []uint
+		for _, child := range pred.Children {
+			dims = append(dims, child.dims()...)
+		}
+		return dims
+	}
+	return []uint{pred.Dim}
+}
+
+// Evaluate the predicate on the DataPoint
+func (pred *Predicate) Eval(dPoint *DataPoint) bool {
+	switch pred.Op {
+	case predAnd:
+		for _, child := range pred.Children {
+			if !child.Eval(dPoint) {
+				return false
+			}
+		}
+		return true
+	case predOr:
+		for _, child := range pred.Children {
+			if child.Eval(dPoint) {
+				return true
+			}
+		}
+		return false
+	case predNot:
+		return !pred.Children[0].Eval(dPoint)
+	}
+	var v float64
+	switch dPoint.getKindByDim(pred.Dim) {
+	case 0:
+		v = dPoint.getFloatValByDim(pred.Dim)
+	case 1:
+		v = float64(dPoint.getIntValByDim(pred.Dim))
+	case 2:
+		return pred.evalString(dPoint.getStringValByDim(pred.Dim))
+	default:
+		return false
+	}
+	if len(pred.Vals) == 0 {
+		// string values on a numeric dim
+		return false
+	}
+	switch pred.Op {
+	case predEq:
+		return v == pred.Vals[0]
+	case predNe:
+		return v != pred.Vals[0]
+	case predLt:
+		return v < pred.Vals[0]
+	case predLe:
+		return v <= pred.Vals[0]
+	case predGt:
+		return v > pred.Vals[0]
+	case predGe:
+		return v >= pred.Vals[0]
+	case predBetween:
+		return v >= pred.Vals[0] && v <= pred.Vals[1]
+	case predIn:
+		for _, val := range pred.Vals {
+			if v == val {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (pred *Predicate) evalString(v string) bool {
+	if len(pred.StrVals) == 0 {
+		return false
+	}
+	switch pred.Op {
+	case predEq:
+		return v == pred.StrVals[0]
+	case predNe:
+		return v != pred.StrVals[0]
+	case predLt:
+		return v < pred.StrVals[0]
+	case predLe:
+		return v <= pred.StrVals[0]
+	case predGt:
+		return v > pred.StrVals[0]
+	case predGe:
+		return v >= pred.StrVals[0]
+	case predBetween:
+		return v >= pred.StrVals[0] && v <= pred.StrVals[1]
+	case predIn:
+		for _, val := range pred.StrVals {
+			if v == val {
+				return true
+			}
+		}
+	case predPrefix:
+		return strings.HasPrefix(v, pred.StrVals[0])
+	case predRegex:
+		if pred.regex != nil {
+			return pred.regex.MatchString(v)
+		}
+		matched, _ := regexp.MatchString(pred.StrVals[0], v)
+		return matched
+	}
+	return false
+}
+
+/*
+Classify the box [mins, maxs] on dims as boxOutside (no point satisfies),
+boxInside (every point satisfies) or boxPartial (unknown)
+Comparisons on dims not in the box are always boxPartial
+*/
+func (pred *Predicate) BoxCheck(dims []uint, mins []float64, maxs []float64) int {
+	switch pred.Op {
+	case predAnd:
+		result := boxInside
+		for _, child := range pred.Children {
+			if r := child.BoxCheck(dims, mins, maxs); r < result {
+				result = r
+			}
+			if result == boxOutside {
+				break
+			}
+		}
+		return result
+	case predOr:
+		result := boxOutside
+		for _, child := range pred.Children {
+			if r := child.BoxCheck(dims, mins, maxs); r > result {
+				result = r
+			}
+			if result == boxInside {
+				break
+			}
+		}
+		return result
+	case predNot:
+		return boxInside - pred.Children[0].BoxCheck(dims, mins, maxs)
+	}
+	ind := -1
+	for i, d := range dims {
+		if d == pred.Dim {
+			ind = i
+			break
+		}
+	}
+	if ind < 0 || len(pred.Vals) == 0 {
+		return boxPartial
+	}
+	min, max := mins[ind], maxs[ind]
+	switch pred.Op {
+	case predEq:
+		return eqBoxCheck(min, max, pred.Vals)
+	case predNe:
+		return boxInside - eqBoxCheck(min, max, pred.Vals)
+	case predLt:
+		return boundBoxCheck(max < pred.Vals[0], min >= pred.Vals[0])
+	case predLe:
+		return boundBoxCheck(max <= pred.Vals[0], min > pred.Vals[0])
+	case predGt:
+		return boundBoxCheck(min > pred.Vals[0], max <= pred.Vals[0])
+	case predGe:
+		return boundBoxCheck(min >= pred.Vals[0], max < pred.Vals[0])
+	case predBetween:
+		return boundBoxCheck(min >= pred.Vals[0] && max <= pred.Vals[1], max < pred.Vals[0] || min > pred.Vals[1])
+	case predIn:
+		return eqBoxCheck(min, max, pred.Vals)
+	}
+	return boxPartial
+}
+
+func boundBoxCheck(inside bool, outside bool) int {
+	if inside {
+		return boxInside
+	} else if outside {
+		return boxOutside
+	}
+	return boxPartial
+}
+
+// Range [min, max] against equality with any of vals
+func eqBoxCheck(min float64, max float64, vals []float64) int {
+	for _, v := range vals {
+		if v >= min && v <= max {
+			if min == max {
+				return boxInside
+			}
+			return boxPartial
+		}
+	}
+	return boxOutside
+}
+
+// Convert the flat conditions of QueryDims, QueryDimVals and QueryDimOpts into a predicate
+// Query Operations in each dim: 0 =; 1 >=; -1 <=
+func flatPredicate(queryDims []uint, queryDimVals []float64, queryDimOpts []int) *Predicate {
+	pred := AndPredicate()
+	for i, d := range queryDims {
+		op := predEq
+		if queryDimOpts[i] > 0 {
+			op = predGe
+		} else if queryDimOpts[i] < 0 {
+			op = predLe
+		}
+		pred.Children = append(pred.Children, CmpPredicate(op, d, queryDimVals[i]))
+	}
+	return pred
+}
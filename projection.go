@@ -0,0 +1,78 @@
+package main
+
+// Dims to decode, indexed by dim, nil decodes every dim
+type columnMask []bool
+
+func maskOfDims(dims []uint) columnMask {
+	if dims == nil {
+		return nil
+	}
+	mask := make(columnMask, 0)
+	for _, d := range dims {
+		for uint(len(mask)) <= d {
+			mask = append(mask, false)
+		}
+		mask[d] = true
+	}
+	return mask
+}
+
+func (mask columnMask) has(d uint) bool {
+	return mask == nil || (d < uint(len(mask)) && mask[d])
+}
+
+// Whether any dim in [from, to) is decoded
+func (mask columnMask) hasRange(from uint, to uint) bool {
+	for d := from; d < to; d++ {
+		if mask.has(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return only the columns in the points of the query, dims numbered as in Predicate
+func (query *Query) SetProjection(columns []uint) {
+	query.Columns = make([]uint, len(columns))
+	copy(query.Columns, columns)
+}
+
+// Dims to decode for the query: the projected columns, the query dims, the predicate dims
+// and the extra dims evaluated by the query, nil without projection
+func (query *Query) decodeDims(extraDims ...[]uint) []uint {
+	if len(query.Columns) == 0 {
+		return nil
+	}
+	dims := append([]uint{}, query.Columns...)
+	dims = append(dims, query.QueryDims...)
+	for _, extra := range extraDims {
+		dims = append(dims, extra...)
+	}
+	if query.Predicate != nil {
+		dims = append(dims, query.Predicate.dims()...)
+	}
+	return dims
+}
+
+/*
+The point reduced to the projected columns of the query, in the order of Columns,
+float columns in FArr, int columns in IArr and string columns in SArr
+Columns the point does not have are skipped
+*/
+func (query *Query) Project(dPoint *DataPoint) DataPoint {
+	if len(query.Columns) == 0 {
+		return *dPoint
+	}
+	projected := DataPoint{Idx: dPoint.Idx}
+	for _, d := range query.Columns {
+		switch dPoint.getKindByDim(d) {
+		case 0:
+			projected.FArr = append(projected.FArr, dPoint.getFloatValByDim(d))
+		case 1:
+			projected.IArr = append(projected.IArr, dPoint.getIntValByDim(d))
+		case 2:
+			projected.SArr = append(projected.SArr, dPoint.getStringValByDim(d))
+		}
+	}
+	return projected
+}
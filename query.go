@@ -3,20 +3,83 @@ package main
 import (
 	"errors"
 	"fmt"
-	"math"
 )
 
 type Query struct {
-	//QueryType = 0, equal, 1, range, 2, knn
+	//QueryType = 0, equal, 1, range, 2, knn, 3, radius, 4, polygon, 5, aggregate, 6, heatmap,
+	// 7, origin-destination trips, 8, origin-destination flow counts, 9, reverse nearest neighbour,
+	// 10, top-N, 11, spatial join with the dataset loaded by Client.SendJoinDataset
 	QueryType int
+	// Set by the client to match the partial results of workers
+	ID int
 	// QueryDims can be duplicated, so that both > < can be
 	// supported at the same time
 	QueryDims    []uint
 	QueryDimVals []float64
 	// Query Operations in each dim: 0 =; 1 >; -1 <, etc
 	QueryDimOpts []int
+	// Optional predicate tree, combined with the flat conditions above by AND
+	// For knn and radius the flat conditions give the center, only Predicate filters
+	Predicate *Predicate
 	// Value K is QueryType = 2, KNN
+	// With a Predicate, the K nearest points satisfying it are returned
+	// Also N of QueryType = 10
 	K int
+	// Approximate KNN: points within a factor 1 + Epsilon of the true distance are accepted,
+	// and MaxCells > 0 stops the search after that many cells, 0 for exact
+	Epsilon  float64
+	MaxCells int
+	// Distance metric: 0 Euclidean, 1 haversine in metres, 2 Manhattan, 3 weighted Euclidean
+	// Haversine takes QueryDims[0] as latitude and QueryDims[1] as longitude
+	Metric int
+	// Weights for Metric = 3, aligned with QueryDims
+	MetricWeights []float64
+	// Radius for QueryType = 3, in the unit of Metric, center in QueryDimVals
+	// Also the join radius of QueryType = 11
+	Radius float64
+	// Polygon for QueryType = 4 and 5, vertices on QueryDims[0] and QueryDims[1]
+	Polygon *Polygon
+	// Aggregate function of QueryType = 5: 0 count, 1 sum, 2 avg, 3 min, 4 max
+	// over the FArr column AggDim, the region is a range or Polygon
+	// QueryType = 6 supports count and sum
+	AggFunc int
+	AggDim  uint
+	// Order of QueryType = 10: the K points of the region (range or Polygon) with the
+	// highest values of the FArr column OrderDim when Descending, the lowest otherwise
+	OrderDim   uint
+	Descending bool
+	// Grid of QueryType = 6 on QueryDims[0] (x) and QueryDims[1] (y), Values is empty
+	// Also the grid of QueryType = 5 grouped by grid, on GroupDims
+	Heatmap *Heatmap
+	// Grouping of QueryType = 5: 0 none, 1 leaf node, 2 pixel of the grid on GroupDims
+	GroupBy   int
+	GroupDims []uint
+	// Regions of QueryType = 7 and 8, a trip matches when its OriginDims (x, y) are in
+	// any of Origins and its DestDims (x, y) are in any of Destinations
+	Origins      []*Polygon
+	OriginDims   []uint
+	Destinations []*Polygon
+	DestDims     []uint
+	// Competing facilities of QueryType = 9, each aligned with QueryDims, the query facility
+	// is QueryDimVals, and the points whose nearest facility it is are returned
+	Facilities [][]float64
+	// Dims of the joined dataset of QueryType = 11, aligned with QueryDims on the points,
+	// with JoinCount the number of points within Radius of each joined point is returned
+	// instead of the pairs
+	JoinDims  []uint
+	JoinCount bool
+	// Pagination of QueryType = 1 and 4: pages of at most PageSize points, 0 for all at once,
+	// starting from Cursor, empty for the first page
+	PageSize int
+	Cursor   string
+	// Cap of the number of points of QueryType = 1 returned at once, 0 for no cap
+	Limit int
+	// Projection of the queries returning points, dims numbered as in Predicate,
+	// empty for whole points, see Project
+	Columns []uint
+	// Explain mode of QueryType = 0 and 1: 0 execute, 1 EXPLAIN the plan without reading points,
+	// 2 ANALYZE, execute the plan and report actual counts and timings
+	Explain int
 	// Later Usage
 	Client string
 }
@@ -36,6 +99,243 @@ func InitQuery(qType int, qDims []uint, qDimVals []float64, qDimOpts []int, k in
 	return q
 }
 
+// Radius query around the center given by qDims and qDimVals
+func InitRadiusQuery(qDims []uint, qDimVals []float64, radius float64, metric int, client string) *Query {
+	q := InitQuery(3, qDims, qDimVals, nil, 0, client)
+	q.Radius = radius
+	q.Metric = metric
+	return q
+}
+
+// Polygon query on the plane of qDims[0] and qDims[1]
+func InitPolygonQuery(qDims []uint, vertices [][]float64, client string) (*Query, error) {
+	if len(qDims) != 2 {
+		err := errors.New(fmt.Sprintf("Polygon query requires 2 dims, got %d", len(qDims)))
+		fmt.Println(err)
+		return nil, err
+	}
+	poly, err := InitPolygon(vertices)
+	if err != nil {
+		return nil, err
+	}
+	q := InitQuery(4, qDims, nil, nil, 0, client)
+	q.Polygon = poly
+	return q, nil
+}
+
+// Heatmap query counting the points in each pixel of a width x height grid
+// over the box [mins, maxs] of qDims[0] and qDims[1], use SetHeatmapSum to sum a column instead
+func InitHeatmapQuery(qDims []uint, mins []float64, maxs []float64, width int, height int, client string) (*Query, error) {
+	if len(qDims) != 2 {
+		err := errors.New(fmt.Sprintf("Heatmap query requires 2 dims, got %d", len(qDims)))
+		fmt.Println(err)
+		return nil, err
+	}
+	hm, err := InitHeatmap(mins, maxs, width, height)
+	if err != nil {
+		return nil, err
+	}
+	q := InitQuery(6, qDims, nil, nil, 0, client)
+	q.Heatmap = hm
+	return q, nil
+}
+
+func (query *Query) SetHeatmapSum(aggDim uint) {
+	query.AggFunc = aggSum
+	query.AggDim = aggDim
+}
+
+// Origin-destination query of qType 7 (trips) or 8 (flow counts between the regions)
+func InitODQuery(qType int, originDims []uint, origins []*Polygon, destDims []uint, destinations []*Polygon, client string) (*Query, error) {
+	if qType != 7 && qType != 8 {
+		err := errors.New(fmt.Sprintf("Query type %d is not an origin-destination query", qType))
+		fmt.Println(err)
+		return nil, err
+	}
+	q := InitQuery(qType, nil, nil, nil, 0, client)
+	q.OriginDims = make([]uint, len(originDims))
+	copy(q.OriginDims, originDims)
+	q.Origins = make([]*Polygon, len(origins))
+	copy(q.Origins, origins)
+	q.DestDims = make([]uint, len(destDims))
+	copy(q.DestDims, destDims)
+	q.Destinations = make([]*Polygon, len(destinations))
+	copy(q.Destinations, destinations)
+	if err := q.ValidateOD(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Reverse nearest neighbour query of the facility qDimVals among the facilities, on qDims
+func InitRNNQuery(qDims []uint, qDimVals []float64, facilities [][]float64, metric int, client string) (*Query, error) {
+	q := InitQuery(9, qDims, qDimVals, nil, 0, client)
+	q.Metric = metric
+	q.Facilities = make([][]float64, len(facilities))
+	for i, f := range facilities {
+		q.Facilities[i] = make([]float64, len(f))
+		copy(q.Facilities[i], f)
+	}
+	if err := q.ValidateRNN(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Spatial join of the points on qDims with the joined dataset on joinDims, pairs within radius
+// are returned, or the counts per joined point when count
+func InitJoinQuery(qDims []uint, joinDims []uint, radius float64, metric int, count bool, client string) (*Query, error) {
+	q := InitQuery(11, qDims, nil, nil, 0, client)
+	q.JoinDims = make([]uint, len(joinDims))
+	copy(q.JoinDims, joinDims)
+	q.Radius = radius
+	q.Metric = metric
+	q.JoinCount = count
+	if _, err := q.SpatialJoin(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Spatial join of the join query, the points of the worker on the left
+func (query *Query) SpatialJoin() (*SpatialJoin, error) {
+	return InitSpatialJoin(query.QueryDims, query.JoinDims, query.Radius, query.Metric, query.MetricWeights)
+}
+
+// Turn the range or polygon query into an aggregate of aggDim over its region
+func (query *Query) SetAggregate(aggFunc int, aggDim uint) {
+	query.QueryType = 5
+	query.AggFunc = aggFunc
+	query.AggDim = aggDim
+}
+
+// Turn the range or polygon query into the n points with the highest or lowest values of orderDim
+func (query *Query) SetTopN(n int, orderDim uint, descending bool) {
+	query.QueryType = 10
+	query.K = n
+	query.OrderDim = orderDim
+	query.Descending = descending
+}
+
+// Group the aggregate by the leaf node of the tree
+func (query *Query) GroupByLeaf() {
+	query.GroupBy = groupLeaf
+}
+
+// Group the aggregate by the pixel of a width x height grid over the box [mins, maxs] of dims
+func (query *Query) GroupByGrid(dims []uint, mins []float64, maxs []float64, width int, height int) error {
+	if len(dims) != 2 {
+		err := errors.New(fmt.Sprintf("Grid grouping requires 2 dims, got %d", len(dims)))
+		fmt.Println(err)
+		return err
+	}
+	grid, err := InitHeatmap(mins, maxs, width, height)
+	if err != nil {
+		return err
+	}
+	query.GroupBy = groupGrid
+	query.GroupDims = []uint{dims[0], dims[1]}
+	query.Heatmap = grid
+	return nil
+}
+
+// Let the KNN query trade accuracy for latency, the achieved error bound is reported with the result
+func (query *Query) SetApproximate(epsilon float64, maxCells int) {
+	query.Epsilon = epsilon
+	query.MaxCells = maxCells
+}
+
+// Return the range or polygon query in pages, resuming from cursor
+func (query *Query) SetPage(pageSize int, cursor string) {
+	query.PageSize = pageSize
+	query.Cursor = cursor
+}
+
+// Return at most limit points of the range query
+func (query *Query) SetLimit(limit int) {
+	query.Limit = limit
+}
+
+// Return the plan of the query instead of its points, executing it when analyze
+func (query *Query) SetExplain(analyze bool) {
+	query.Explain = explainPlan
+	if analyze {
+		query.Explain = explainAnalyze
+	}
+}
+
+func (query *Query) SetMetric(metric int, weights []float64) {
+	query.Metric = metric
+	query.MetricWeights = make([]float64, len(weights))
+	copy(query.MetricWeights, weights)
+}
+
+/*
+Build the distance metric of the query for values ordered by dims
+Only the QueryDims are measured, the center has no value on the other dims, so a metric
+over a tree with more dims ignores them
+*/
+func (query *Query) DistanceMetric(dims []uint) (DistanceMetric, error) {
+	dimMap := make(map[uint]int)
+	for i, d := range dims {
+		dimMap[d] = i
+	}
+	inds := make([]int, len(query.QueryDims))
+	projected := len(dims) != len(query.QueryDims)
+	for i, d := range query.QueryDims {
+		ind, exists := dimMap[d]
+		if !exists {
+			err := errors.New(fmt.Sprintf("Dimension %d not exist in data", d))
+			fmt.Println(err)
+			return nil, err
+		}
+		inds[i] = ind
+		projected = projected || ind != i
+	}
+
+	// the metric on values ordered by QueryDims
+	var metric DistanceMetric
+	switch query.Metric {
+	case 0:
+		metric = &EuclideanMetric{}
+	case 1:
+		if len(query.QueryDims) < 2 {
+			err := errors.New(fmt.Sprintf("Haversine requires latitude and longitude dims, got %d dims", len(query.QueryDims)))
+			fmt.Println(err)
+			return nil, err
+		}
+		metric = &HaversineMetric{LatInd: 0, LonInd: 1}
+	case 2:
+		metric = &ManhattanMetric{}
+	case 3:
+		weights := make([]float64, len(query.QueryDims))
+		for i := range weights {
+			weights[i] = 1
+			if i < len(query.MetricWeights) {
+				weights[i] = query.MetricWeights[i]
+			}
+		}
+		metric = &WeightedMetric{Weights: weights}
+	default:
+		err := errors.New(fmt.Sprintf("Unknown distance metric %d", query.Metric))
+		fmt.Println(err)
+		return nil, err
+	}
+	if !projected {
+		return metric, nil
+	}
+	return &ProjectedMetric{Metric: metric, Inds: inds}, nil
+}
+
+// The flat conditions and the predicate tree of the query as a single predicate
+func (query *Query) ToPredicate() *Predicate {
+	pred := flatPredicate(query.QueryDims, query.QueryDimVals, query.QueryDimOpts)
+	if query.Predicate != nil {
+		pred.Children = append(pred.Children, query.Predicate)
+	}
+	return pred
+}
+
 // Check Whether DataPoint satisfies the query requirement
 func (query *Query) CheckPoint(dPoint *DataPoint) bool {
 	for i, d := range query.QueryDims {
@@ -50,26 +350,206 @@ func (query *Query) CheckPoint(dPoint *DataPoint) bool {
 			}
 		}
 	}
+	if query.Predicate != nil {
+		return query.Predicate.Eval(dPoint)
+	}
 	return true
 }
 
-// Compute the Euclidean distance between the datapoint and query center
+// Check whether DataPoint is in the region of a range or polygon query
+func (query *Query) CheckRegion(dPoint *DataPoint) bool {
+	if query.Polygon == nil {
+		return query.CheckPoint(dPoint)
+	}
+	if !query.Polygon.Contains(dPoint.getFloatValByDim(query.QueryDims[0]), dPoint.getFloatValByDim(query.QueryDims[1])) {
+		return false
+	}
+	return query.CheckPredicate(dPoint)
+}
+
+// Classify the box as boxOutside, boxPartial or boxInside the region of a range or polygon query
+func (query *Query) RegionBoxCheck(dims []uint, mins []float64, maxs []float64) int {
+	if query.Polygon == nil {
+		return query.ToPredicate().BoxCheck(dims, mins, maxs)
+	}
+	result := boxPartial
+	if xInd, yInd, err := polygonDimInds(dims, query.QueryDims[0], query.QueryDims[1]); err == nil {
+		result = query.Polygon.BoxRelation(mins[xInd], mins[yInd], maxs[xInd], maxs[yInd])
+	}
+	if query.Predicate != nil && result != boxOutside {
+		if r := query.Predicate.BoxCheck(dims, mins, maxs); r < result {
+			result = r
+		}
+	}
+	return result
+}
+
+// Validate the region of a range or polygon query
+func (query *Query) ValidateRegion() error {
+	if query.Polygon != nil && len(query.QueryDims) != 2 {
+		err := errors.New(fmt.Sprintf("Polygon query requires 2 dims, got %d", len(query.QueryDims)))
+		fmt.Println(err)
+		return err
+	}
+	if query.Polygon == nil && (len(query.QueryDimVals) != len(query.QueryDims) || len(query.QueryDimOpts) != len(query.QueryDims)) {
+		err := errors.New(fmt.Sprintf("Range query requires a value and an operation for each of %d dims", len(query.QueryDims)))
+		fmt.Println(err)
+		return err
+	}
+	return query.ValidatePredicate()
+}
+
+// Validate the N and the region of a top-N query
+func (query *Query) ValidateTopN() error {
+	if query.K <= 0 {
+		err := errors.New(fmt.Sprintf("Top-N query requires a positive N, got %d", query.K))
+		fmt.Println(err)
+		return err
+	}
+	return query.ValidateRegion()
+}
+
+// Validate the grouping of an aggregate query
+func (query *Query) ValidateGroupBy() error {
+	switch query.GroupBy {
+	case groupNone, groupLeaf:
+		return nil
+	case groupGrid:
+		if query.Heatmap == nil || len(query.GroupDims) != 2 {
+			err := errors.New(fmt.Sprintf("Grid grouping requires a grid and 2 dims, got %d dims", len(query.GroupDims)))
+			fmt.Println(err)
+			return err
+		}
+		_, err := InitHeatmap(query.Heatmap.Mins, query.Heatmap.Maxs, query.Heatmap.Width, query.Heatmap.Height)
+		return err
+	}
+	err := errors.New(fmt.Sprintf("Unknown grouping %d", query.GroupBy))
+	fmt.Println(err)
+	return err
+}
+
+// Validate the regions of an origin-destination query
+func (query *Query) ValidateOD() error {
+	if len(query.OriginDims) != 2 || len(query.DestDims) != 2 {
+		err := errors.New(fmt.Sprintf("Origin-destination query requires 2 origin and 2 destination dims, got %d and %d",
+			len(query.OriginDims), len(query.DestDims)))
+		fmt.Println(err)
+		return err
+	}
+	if len(query.Origins) == 0 || len(query.Destinations) == 0 {
+		err := errors.New(fmt.Sprintf("Origin-destination query requires regions, got %d origins and %d destinations",
+			len(query.Origins), len(query.Destinations)))
+		fmt.Println(err)
+		return err
+	}
+	for _, region := range append(append([]*Polygon{}, query.Origins...), query.Destinations...) {
+		if region == nil || len(region.Vertices) < 3 {
+			err := errors.New("Origin-destination regions must be polygons of at least 3 vertices")
+			fmt.Println(err)
+			return err
+		}
+	}
+	return query.ValidatePredicate()
+}
+
+// Validate the facilities of a reverse nearest neighbour query
+func (query *Query) ValidateRNN() error {
+	if len(query.QueryDims) == 0 || len(query.QueryDimVals) != len(query.QueryDims) {
+		err := errors.New(fmt.Sprintf("Reverse nearest neighbour query requires a facility value for each of %d dims, got %d",
+			len(query.QueryDims), len(query.QueryDimVals)))
+		fmt.Println(err)
+		return err
+	}
+	for i, f := range query.Facilities {
+		if len(f) != len(query.QueryDims) {
+			err := errors.New(fmt.Sprintf("Facility %d has %d values, query has %d dims", i, len(f), len(query.QueryDims)))
+			fmt.Println(err)
+			return err
+		}
+	}
+	return query.ValidatePredicate()
+}
+
+// Bounding boxes of the origin and destination regions and the predicate tree as a single predicate
+func (query *Query) odPredicate() *Predicate {
+	regionsPredicate := func(regions []*Polygon, xyDims []uint) *Predicate {
+		pred := OrPredicate()
+		for _, region := range regions {
+			xmin, ymin, xmax, ymax := region.Bounds()
+			pred.Children = append(pred.Children, AndPredicate(
+				CmpPredicate(predBetween, xyDims[0], xmin, xmax),
+				CmpPredicate(predBetween, xyDims[1], ymin, ymax)))
+		}
+		return pred
+	}
+	pred := AndPredicate(regionsPredicate(query.Origins, query.OriginDims), regionsPredicate(query.Destinations, query.DestDims))
+	if query.Predicate != nil {
+		pred.Children = append(pred.Children, query.Predicate)
+	}
+	return pred
+}
+
+// Validate the grid of a heatmap query
+func (query *Query) ValidateHeatmap() error {
+	if query.Heatmap == nil || len(query.QueryDims) != 2 {
+		err := errors.New(fmt.Sprintf("Heatmap query requires a grid and 2 dims, got %d dims", len(query.QueryDims)))
+		fmt.Println(err)
+		return err
+	}
+	if query.AggFunc != aggCount && query.AggFunc != aggSum {
+		err := errors.New(fmt.Sprintf("Heatmap query supports count and sum, got aggregate function %d", query.AggFunc))
+		fmt.Println(err)
+		return err
+	}
+	if _, err := InitHeatmap(query.Heatmap.Mins, query.Heatmap.Maxs, query.Heatmap.Width, query.Heatmap.Height); err != nil {
+		return err
+	}
+	return query.ValidatePredicate()
+}
+
+// The box of the heatmap and the predicate tree of the query as a single predicate
+func (query *Query) heatmapPredicate() *Predicate {
+	pred := AndPredicate(
+		CmpPredicate(predBetween, query.QueryDims[0], query.Heatmap.Mins[0], query.Heatmap.Maxs[0]),
+		CmpPredicate(predBetween, query.QueryDims[1], query.Heatmap.Mins[1], query.Heatmap.Maxs[1]))
+	if query.Predicate != nil {
+		pred.Children = append(pred.Children, query.Predicate)
+	}
+	return pred
+}
+
+// Check only the predicate tree, used when the flat conditions describe a center (knn, radius)
+func (query *Query) CheckPredicate(dPoint *DataPoint) bool {
+	if query.Predicate == nil {
+		return true
+	}
+	return query.Predicate.Eval(dPoint)
+}
+
+// Validate the predicate tree of the query, if any
+func (query *Query) ValidatePredicate() error {
+	if query.Predicate == nil {
+		return nil
+	}
+	return query.Predicate.Validate()
+}
+
+// Compute the distance between the datapoint and query center with the query metric
 func (query *Query) DistanceToCenter(dPoint *DataPoint) float64 {
-	if query.QueryType != 2 || query.K <= 0 {
+	if (query.QueryType != 2 || query.K <= 0) && query.QueryType != 3 {
 		return float64(-1)
 	}
-	distance := float64(0)
-	for i, d := range query.QueryDims {
-		diff := dPoint.getFloatValByDim(d) - query.QueryDimVals[i]
-		distance += math.Pow(diff, 2)
+	metric, err := query.DistanceMetric(query.QueryDims)
+	if err != nil {
+		return float64(-1)
 	}
-	return math.Sqrt(distance)
+	return metric.Distance(dPoint.getFloatValsByDims(query.QueryDims), query.QueryDimVals)
 }
 
-// Convert the query to a float array storing the knn center info
+// Convert the query to a float array storing the knn or radius center info
 func (query *Query) ToDimFloatVal(dTree *DTree) ([]float64, error) {
-	if query.K < 0 {
-		err := errors.New(fmt.Sprintf("Query is not KNN, but tries to convert fake data"))
+	if query.K < 0 && query.QueryType != 3 {
+		err := errors.New(fmt.Sprintf("Query is not KNN or radius, but tries to convert fake data"))
 		fmt.Println(err)
 		return nil, err
 	}
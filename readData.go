@@ -3,33 +3,66 @@ package main
 import (
 	"bufio"
 	"encoding/csv"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"strconv"
+	"time"
+)
+
+const (
+	// Layout of the datetime columns, read as UTC
+	timeLayout = "2006-01-02 15:04:05"
 )
 
 //Example
 func ImportData(path string) ([]DataPoint, error) {
 	//dropoff_datetime, pickup_datetime, dropoff_longitude, dropoff_latitude, pickup_longitude, pickup_latitude, trip_distance, total_amount, tip_amount
+	// FArr: dropoff_longitude ... tip_amount, then dropoff and pickup timestamps at 7 and 8
 	a := AttributeDataPointMapping{
 		FloatArr:  []int{2, 3, 4, 5, 6, 7, 8},
+		TimeArr:   []int{0, 1},
 		StringArr: []int{0, 1},
 	}
 	return importCSV2DataPoint(path, a)
 }
 
+// Schema of the points of ImportData, NEAREST and WITHIN default to the dropoff location,
+// the dims of the client tree
+func ImportSchema() *Schema {
+	return InitSchema(
+		[]string{"dropoff_longitude", "dropoff_latitude", "pickup_longitude", "pickup_latitude",
+			"trip_distance", "total_amount", "tip_amount", "dropoff_ts", "pickup_ts"},
+		nil,
+		[]string{"dropoff_datetime", "pickup_datetime"},
+		[]string{"dropoff_latitude", "dropoff_longitude"})
+}
+
 //AttributeDataPointMapping ..
 type AttributeDataPointMapping struct {
-	FloatArr  []int
+	FloatArr []int
+	// Datetime columns, parsed into epoch seconds and appended to FArr after FloatArr
+	TimeArr   []int
 	IntArr    []int
 	StringArr []int
 }
 
+// ParseTimestamp converts a datetime in timeLayout into epoch seconds
+func ParseTimestamp(s string) (float64, error) {
+	t, err := time.Parse(timeLayout, s)
+	if err != nil {
+		return 0, err
+	}
+	return float64(t.Unix()), nil
+}
+
 func importCSV2DataPoint(path string, attributeOrder AttributeDataPointMapping) ([]DataPoint, error) {
 	csvFile, _ := os.Open(path)
 	reader := csv.NewReader(bufio.NewReader(csvFile))
 	var dPointArr []DataPoint
 	count := 0
+rows:
 	for {
 		line, err := reader.Read()
 		count++
@@ -44,6 +77,16 @@ func importCSV2DataPoint(path string, attributeOrder AttributeDataPointMapping)
 			f, _ := strconv.ParseFloat(line[attributeOrder.FloatArr[order]], 64)
 			fArr = append(fArr, f)
 		}
+		for order := range attributeOrder.TimeArr {
+			f, err := ParseTimestamp(line[attributeOrder.TimeArr[order]])
+			if err != nil {
+				// a zero timestamp would land the point in the wrong cells, skip the row
+				err := errors.New(fmt.Sprintf("Skip row %d with invalid datetime %q", count, line[attributeOrder.TimeArr[order]]))
+				fmt.Println(err)
+				continue rows
+			}
+			fArr = append(fArr, f)
+		}
 
 		var iArr []int
 		for order := range attributeOrder.IntArr {
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Rows with an invalid datetime are skipped instead of imported at epoch 0
+func TestImportSkipsInvalidDatetime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trips.csv")
+	csv := "dropoff_datetime,pickup_datetime,dropoff_longitude,dropoff_latitude,pickup_longitude,pickup_latitude,trip_distance,total_amount,tip_amount\n" +
+		"2015-09-20 12:10:00,2015-09-20 12:00:00,-73.98,40.75,-73.99,40.74,1.2,10.5,2\n" +
+		"2015-09-20 12:20:00,not a datetime,-73.97,40.76,-73.98,40.75,0.8,7.5,1\n" +
+		"2015-09-20 12:40:00,2015-09-20 12:30:00,-73.96,40.77,-73.97,40.76,2.1,15,3\n"
+	if err := os.WriteFile(path, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	points, err := ImportData(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("got %d points, want 2", len(points))
+	}
+	want, _ := ParseTimestamp("2015-09-20 12:30:00")
+	if points[1].FArr[8] != want {
+		t.Fatalf("got pickup %v, want %v", points[1].FArr[8], want)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	resultCacheEntries = 1000
+	resultCachePoints  = 1000000
+)
+
+// Hit and miss statistics of the result cache
+type CacheStats struct {
+	Hits          int
+	Misses        int
+	Inserts       int
+	Evictions     int
+	Invalidations int
+	Entries       int
+	Points        int
+}
+
+type cacheEntry struct {
+	key      string
+	points   []DataPoint
+	cubeInds []int
+}
+
+/*
+ResultCache keeps the results of repeated queries, keyed by Query.cacheKey
+Each entry records the leaves its result depends on and is dropped when one of them is fed,
+the least recently used entries are evicted beyond maxEntries entries or maxPoints points
+*/
+type ResultCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxPoints  int
+	// front is the most recently used, values are *cacheEntry
+	lru     *list.List
+	entries map[string]*list.Element
+	// keys of the entries depending on each leaf
+	byCube map[int]map[string]bool
+	// increased by every invalidation, see Put
+	version int
+	stats   CacheStats
+}
+
+func InitResultCache(maxEntries int, maxPoints int) *ResultCache {
+	return &ResultCache{
+		maxEntries: maxEntries,
+		maxPoints:  maxPoints,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		byCube:     make(map[int]map[string]bool),
+	}
+}
+
+// Cached result of the key, shared with the cache so not to be modified
+func (cache *ResultCache) Get(key string) ([]DataPoint, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	elem, exists := cache.entries[key]
+	if !exists {
+		cache.stats.Misses++
+		return nil, false
+	}
+	cache.stats.Hits++
+	cache.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).points, true
+}
+
+// Version to pass to Put, taken before executing the query
+func (cache *ResultCache) Version() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.version
+}
+
+// Cache the result of the key depending on the leaves cubeInds, unless some leaf was fed
+// since version, which may have made the result stale, or the result alone is over maxPoints
+func (cache *ResultCache) Put(key string, points []DataPoint, cubeInds []int, version int) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if version != cache.version || len(points) > cache.maxPoints {
+		return
+	}
+	if _, exists := cache.entries[key]; exists {
+		return
+	}
+	entry := &cacheEntry{key: key, points: points, cubeInds: cubeInds}
+	cache.entries[key] = cache.lru.PushFront(entry)
+	for _, cubeInd := range cubeInds {
+		if cache.byCube[cubeInd] == nil {
+			cache.byCube[cubeInd] = make(map[string]bool)
+		}
+		cache.byCube[cubeInd][key] = true
+	}
+	cache.stats.Inserts++
+	cache.stats.Points += len(points)
+	for len(cache.entries) > cache.maxEntries || cache.stats.Points > cache.maxPoints {
+		cache.remove(cache.lru.Back())
+		cache.stats.Evictions++
+	}
+}
+
+func (cache *ResultCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	cache.lru.Remove(elem)
+	delete(cache.entries, entry.key)
+	for _, cubeInd := range entry.cubeInds {
+		delete(cache.byCube[cubeInd], entry.key)
+		if len(cache.byCube[cubeInd]) == 0 {
+			delete(cache.byCube, cubeInd)
+		}
+	}
+	cache.stats.Points -= len(entry.points)
+}
+
+// Drop the entries depending on the leaf, called when it is fed
+func (cache *ResultCache) Invalidate(cubeInd int) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.version++
+	for key := range cache.byCube[cubeInd] {
+		cache.remove(cache.entries[key])
+		cache.stats.Invalidations++
+	}
+}
+
+// Drop every entry, called when the tree changes
+func (cache *ResultCache) Clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.version++
+	cache.stats.Invalidations += len(cache.entries)
+	cache.lru.Init()
+	cache.entries = make(map[string]*list.Element)
+	cache.byCube = make(map[int]map[string]bool)
+	cache.stats.Points = 0
+}
+
+func (cache *ResultCache) Statistics() CacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	stats := cache.stats
+	stats.Entries = len(cache.entries)
+	return stats
+}
+
+// Whether the result of the query is cached: exact range and KNN queries returning all points at once
+func (query *Query) cacheable() bool {
+	if query.PageSize > 0 || query.Explain != explainNone {
+		return false
+	}
+	return query.QueryType == 1 || (query.QueryType == 2 && query.Epsilon == 0 && query.MaxCells == 0)
+}
+
+// Conditions of a range query, sorted by dim, operation then value
+type rangeConds struct {
+	dims []uint
+	vals []float64
+	opts []int
+}
+
+func (c rangeConds) Len() int { return len(c.dims) }
+func (c rangeConds) Less(i, j int) bool {
+	if c.dims[i] != c.dims[j] {
+		return c.dims[i] < c.dims[j]
+	}
+	if c.opts[i] != c.opts[j] {
+		return c.opts[i] < c.opts[j]
+	}
+	return c.vals[i] < c.vals[j]
+}
+func (c rangeConds) Swap(i, j int) {
+	c.dims[i], c.dims[j] = c.dims[j], c.dims[i]
+	c.vals[i], c.vals[j] = c.vals[j], c.vals[i]
+	c.opts[i], c.opts[j] = c.opts[j], c.opts[i]
+}
+
+// Canonical form of the query, equal for queries with the same result: the ID and client are
+// dropped and the conditions of a range query sorted
+func (query *Query) cacheKey() string {
+	q := *query
+	q.ID, q.Client = 0, ""
+	if q.QueryType == 1 && len(q.QueryDimVals) == len(q.QueryDims) && len(q.QueryDimOpts) == len(q.QueryDims) {
+		conds := rangeConds{append([]uint{}, q.QueryDims...), append([]float64{}, q.QueryDimVals...), append([]int{}, q.QueryDimOpts...)}
+		sort.Sort(conds)
+		q.QueryDims, q.QueryDimVals, q.QueryDimOpts = conds.dims, conds.vals, conds.opts
+	}
+	b, _ := json.Marshal(&q)
+	return string(b)
+}
+
+/*
+Execute the query through the result cache
+A range result depends on the leaves of the range, a KNN result on the leaves within the
+distance of its K-th point, any leaf when less than K points exist. Feeds invalidate only
+the cache of the worker storing the leaf, so a result is cached only when all its leaves
+are owned by this worker, queries spanning the leaves of several workers always run
+*/
+func (w *Worker) executeCached(q *Query) ([]DataPoint, error) {
+	if w.results == nil || !q.cacheable() {
+		return w.executeQuery(q)
+	}
+	key := q.cacheKey()
+	if dataPoints, exists := w.results.Get(key); exists {
+		return dataPoints, nil
+	}
+	version := w.results.Version()
+	var dataPoints []DataPoint
+	var cubeInds []int
+	var err error
+	if q.QueryType == 1 {
+		if dataPoints, _, err = w.RangeQuery(q); err != nil {
+			return nil, err
+		}
+		cubeInds, _ = w.dTree.PredicateSearch(q.ToPredicate())
+	} else {
+		var distances []float64
+		if dataPoints, distances, _, err = w.knnSearch(q); err != nil {
+			return nil, err
+		}
+		if cubeInds, err = w.knnLeaves(q, distances); err != nil {
+			return dataPoints, nil
+		}
+	}
+	for _, cubeInd := range cubeInds {
+		if w.cubeList[cubeInd] != w.id {
+			return dataPoints, nil
+		}
+	}
+	w.results.Put(key, dataPoints, cubeInds, version)
+	return dataPoints, nil
+}
+
+// Leaves holding the points that could change the result of a KNN query with these distances
+func (w *Worker) knnLeaves(q *Query, distances []float64) ([]int, error) {
+	radius := math.Inf(1)
+	if len(distances) == q.K && q.K > 0 {
+		radius = distances[len(distances)-1]
+	}
+	metric, err := q.DistanceMetric(w.dTree.Dims)
+	if err != nil {
+		return nil, err
+	}
+	centerData, err := q.ToDimFloatVal(w.dTree)
+	if err != nil {
+		return nil, err
+	}
+	return w.dTree.RadiusSearch(centerData, radius, metric)
+}
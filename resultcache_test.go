@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+// KNN results are cached when their leaves are stored here, and not when some leaf is stored
+// on another worker whose feeds are not seen here
+func TestResultCacheKNNOwnedLeaves(t *testing.T) {
+	points := testPoints(3000)
+	query := InitQuery(2, []uint{0, 1}, []float64{40.75, -73.95}, nil, 50, "")
+
+	worker := testWorker(t, points)
+	worker.results = InitResultCache(resultCacheEntries, resultCachePoints)
+	if _, err := worker.executeCached(query); err != nil {
+		t.Fatal(err)
+	}
+	if stats := worker.results.Statistics(); stats.Inserts != 1 {
+		t.Fatalf("got %d inserts on a worker owning every leaf, want 1", stats.Inserts)
+	}
+
+	worker, _ = testCluster(t, points)
+	worker.results = InitResultCache(resultCacheEntries, resultCachePoints)
+	result, err := worker.executeCached(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != query.K {
+		t.Fatalf("got %d points, want %d", len(result), query.K)
+	}
+	if stats := worker.results.Statistics(); stats.Inserts != 0 {
+		t.Fatalf("got %d inserts with leaves of another worker, want 0", stats.Inserts)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+)
+
+// Whether some competing facility is closer than the query facility to every point
+// of the box [mins, maxs] on the query dims
+// By the triangle inequality a point within half the distance between the facilities
+// is closer to the competing one
+func (query *Query) rnnDominated(metric DistanceMetric, mins []float64, maxs []float64) bool {
+	lower := metric.LowerBound(query.QueryDimVals, mins, maxs)
+	for _, f := range query.Facilities {
+		bound := math.Max(lower, metric.Distance(f, query.QueryDimVals)/2)
+		if metric.UpperBound(f, mins, maxs) < bound {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the query facility is a nearest facility of the point
+func (query *Query) rnnNearest(metric DistanceMetric, dPoint *DataPoint) bool {
+	vals := dPoint.getFloatValsByDims(query.QueryDims)
+	distance := metric.Distance(vals, query.QueryDimVals)
+	for _, f := range query.Facilities {
+		if metric.Distance(vals, f) < distance {
+			return false
+		}
+	}
+	return true
+}
+
+// Find all leaf nodes that may contain points whose nearest facility is the query one
+// Retrun the indices of node
+func (dTree *DTree) RNNSearch(query *Query, metric DistanceMetric) ([]int, error) {
+	if err := query.ValidateRNN(); err != nil {
+		return nil, err
+	}
+	finalNodeList := make([]int, 0)
+	currList := []int{}
+	nextList := []int{0}
+	for len(nextList) > 0 {
+		currList = nextList
+		nextList = make([]int, 0)
+		for _, nodeInd := range currList {
+			node := &dTree.Nodes[nodeInd]
+			if query.Predicate != nil && query.Predicate.BoxCheck(node.Dims, node.Mins, node.Maxs) == boxOutside {
+				continue
+			}
+			boxMins, boxMaxs := joinBox(node.Dims, node.Mins, node.Maxs, query.QueryDims)
+			if query.rnnDominated(metric, boxMins, boxMaxs) {
+				continue
+			}
+			if node.IsLeaf {
+				finalNodeList = append(finalNodeList, nodeInd)
+			} else {
+				nextList = append(nextList, int(node.LInd))
+				nextList = append(nextList, int(node.RInd))
+			}
+		}
+	}
+	return finalNodeList, nil
+}
+
+/*
+Return the points whose nearest facility among query.Facilities and the query facility
+is the query facility, ties included, and the number of cells read
+Distances are measured on QueryDims with the query metric, a node or cell is pruned when
+one facility is closer to all of its box than the query facility could be
+Leaves owned by other workers are read whole from their owners
+*/
+func (worker *Worker) RNNQuery(query *Query) ([]DataPoint, int, error) {
+	metric, err := query.DistanceMetric(query.QueryDims)
+	if err != nil {
+		return nil, 0, err
+	}
+	cubeInds, err := worker.dTree.RNNSearch(query, metric)
+	if err != nil {
+		return nil, 0, err
+	}
+	var dPoints []DataPoint
+	var remoteInds []int
+	cellNum := 0
+	decodeDims := query.decodeDims()
+	for _, cubeInd := range cubeInds {
+		node := &worker.dTree.Nodes[cubeInd]
+		if worker.cubeList[cubeInd] != worker.id {
+			remoteInds = append(remoteInds, cubeInd)
+			cellNum += int(node.Capacity)
+			continue
+		}
+		var metaInds []int
+		for metaInd := 0; metaInd < int(node.Capacity); metaInd++ {
+			cellMins, cellMaxs, _ := node.Boundary(metaInd)
+			if query.Predicate != nil && query.Predicate.BoxCheck(node.Dims, cellMins, cellMaxs) == boxOutside {
+				continue
+			}
+			boxMins, boxMaxs := joinBox(node.Dims, cellMins, cellMaxs, query.QueryDims)
+			if !query.rnnDominated(metric, boxMins, boxMaxs) {
+				metaInds = append(metaInds, metaInd)
+			}
+		}
+		if len(metaInds) == 0 {
+			continue
+		}
+		cellNum += len(metaInds)
+		dPoints = append(dPoints, worker.db.ReadBatchColumns(cubeInd, metaInds, decodeDims)...)
+	}
+	dPoints = append(dPoints, worker.getAll(remoteInds, decodeDims)...)
+
+	var dataPoints []DataPoint
+	for _, dp := range dPoints {
+		if query.rnnNearest(metric, &dp) && query.CheckPredicate(&dp) {
+			dataPoints = append(dataPoints, query.Project(&dp))
+		}
+	}
+	return dataPoints, cellNum, nil
+}
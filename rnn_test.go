@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+// RNN on a worker reads the leaves of the other worker from it
+func TestRNNQueryRemoteLeaves(t *testing.T) {
+	points := testPoints(3000)
+	worker, _ := testCluster(t, points)
+	facilities := [][]float64{{40.7, -74.0}, {40.8, -73.9}, {40.85, -74.05}}
+	query, err := InitRNNQuery([]uint{0, 1}, []float64{40.75, -73.95}, facilities, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _, err := worker.RNNQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric, _ := query.DistanceMetric(query.QueryDims)
+	want := 0
+	for i := range points {
+		if query.rnnNearest(metric, &points[i]) {
+			want++
+		}
+	}
+	if want == 0 || len(result) != want {
+		t.Fatalf("got %d points, want %d", len(result), want)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -22,17 +23,25 @@ const (
 	tcpPort            = 1003
 	randomSampleRatio  = 0.1
 	readSingleAllRatio = 0.5
+	// cubeFormat is the version of the data format written by convertDPoint,
+	// cubes of another version can not be decoded and have to be imported again
+	cubeFormat = 1
 )
 
 type DB struct {
-	CubeMetaMap map[int]string    //  key: treeNodeidx Value: metafilepath
-	Cube        map[int]*MetaCube // fixed size
+	RootPath    string              // directory of the cubes, one sub directory per cube
+	CubeMetaMap map[int]string      //  key: treeNodeidx Value: metafilepath
+	Cube        map[int]*MetaCube   // fixed size
+	CellAggDims []uint              // FArr columns to maintain per-cell aggregates for in new cubes
+	OnFeed      func(cubeIndex int) // called after Feed appends to a cube, nil for none
 }
 
 type CubeCell struct {
 	Count    int
 	CellHead uint32 // Offset (listhead) of cubelist
 	CellTail uint32 // listTail of cubelist
+	// Running aggregates aligned with MetaInfo.AggDims
+	Aggs []Aggregate `json:",omitempty"`
 }
 
 // MapInd() int
@@ -45,6 +54,8 @@ type MetaInfo struct {
 	Maxs         []float64
 	CellArr      []CubeCell
 	GlobalOffset uint32 //global offset in DataArr
+	AggDims      []uint `json:",omitempty"`
+	Format       int    `json:",omitempty"` // cubeFormat the cube was written in
 }
 
 type MetaCube struct {
@@ -63,8 +74,15 @@ func check(err error) {
 // Init DB initialize the metadata info from dbRootPath, construct a map of index -> metadatafilePath, where
 // index is the name of the file. e.g. map[1][dbRootPath/index/index.meta]
 func InitDB() (*DB, error) {
+	return InitDBAt(dbRootPath)
+}
+
+// InitDBAt initializes a DB storing its cubes under rootPath, datasets stored side by side
+// need distinct root paths as their cube indices overlap
+func InitDBAt(rootPath string) (*DB, error) {
 
 	db := new(DB)
+	db.RootPath = rootPath
 	db.CubeMetaMap = make(map[int]string)
 	db.Cube = make(map[int]*MetaCube)
 
@@ -99,7 +117,9 @@ func (db *DB) shuffleCube(cubeIndex int) {
 		return
 	} else {
 		if len(db.Cube) < cacheSize {
-			db.Cube[cubeIndex], _ = loadMetaFromDisk(cubeIndex)
+			cube, err := loadMetaFromDisk(db.RootPath, cubeIndex)
+			check(err)
+			db.Cube[cubeIndex] = cube
 		} else {
 			// find a randomized map entity, shuffle it with cubeIndex
 			/*
@@ -112,10 +132,12 @@ func (db *DB) shuffleCube(cubeIndex int) {
 				indexToReplace := keys[randomFig]
 			*/
 			indexToReplace := db.FindReplaceIndex()
-			err := db.Cube[indexToReplace].writeToDisk()
+			err := db.Cube[indexToReplace].writeToDisk(db.RootPath)
 			check(err)
 			delete(db.Cube, indexToReplace)
-			db.Cube[cubeIndex], _ = loadMetaFromDisk(cubeIndex)
+			cube, err := loadMetaFromDisk(db.RootPath, cubeIndex)
+			check(err)
+			db.Cube[cubeIndex] = cube
 		}
 	}
 	return
@@ -135,29 +157,40 @@ func getDataHeader(header []byte) (nextHead uint32, totalLength uint32, floatNum
 }
 
 func convertByteTodPoint(data []byte, floatNum uint32, intNum uint32, stringNum uint32) DataPoint {
+	return convertByteTodPointColumns(data, floatNum, intNum, stringNum, nil)
+}
+
+// Decode only the dims set in the mask, the others keep their zero value
+// Strings are split only when one of them is needed
+func convertByteTodPointColumns(data []byte, floatNum uint32, intNum uint32, stringNum uint32, mask columnMask) DataPoint {
 	d := new(DataPoint)
 	dataHead := uint32(0)
 
 	d.FArr = make([]float64, floatNum)
 	for i := uint32(0); i < floatNum; i++ {
-		d.FArr[i] = Float64frombytes(data[dataHead : dataHead+8])
+		if mask.has(uint(i)) {
+			d.FArr[i] = Float64frombytes(data[dataHead : dataHead+8])
+		}
 		dataHead += 8
 	}
 
 	d.IArr = make([]int, intNum)
 	for i := uint32(0); i < intNum; i++ {
-		json.Unmarshal(data[dataHead:dataHead+4], &d.IArr[i])
+		if mask.has(uint(floatNum + i)) {
+			d.IArr[i] = int(int32(binary.BigEndian.Uint32(data[dataHead : dataHead+4])))
+		}
 		dataHead += 4
 	}
 
 	d.SArr = make([]string, stringNum)
-	if stringNum > 0 {
+	if stringNum > 0 && mask.hasRange(uint(floatNum+intNum), uint(floatNum+intNum+stringNum)) {
 
 		var str string
 		str = string(data[dataHead:len(data)])
 		// json.Unmarshal(data[dataHead:len(data)], &str)
 		//fmt.Printf("stringNum is %d, str is %s, len of string is %d\n", stringNum, str, len(str))
-		d.SArr = strings.Split(str, "\t")
+		// every string is terminated by a tab
+		d.SArr = strings.Split(strings.TrimSuffix(str, "\t"), "\t")
 	}
 
 	return *d
@@ -166,6 +199,12 @@ func convertByteTodPoint(data []byte, floatNum uint32, intNum uint32, stringNum
 // ReadSingle is a function that read single point from .data file
 // Depending whether the dataArr is in memory or not
 func (db *DB) ReadSingle(cubeIndex int, metaIndex int) []DataPoint {
+	return db.ReadSingleColumns(cubeIndex, metaIndex, nil)
+}
+
+// ReadSingleColumns reads the cell decoding only the given dims, nil for every dim
+func (db *DB) ReadSingleColumns(cubeIndex int, metaIndex int, dims []uint) []DataPoint {
+	mask := maskOfDims(dims)
 	// check if the cubeIndex is in cubemap, if not, load datacube to map
 	db.shuffleCube(cubeIndex)
 	// | offset(4bit) | header(| totalLength | FloatNum | IntNum | StringNum |) | data(float|int|string) |
@@ -176,9 +215,13 @@ func (db *DB) ReadSingle(cubeIndex int, metaIndex int) []DataPoint {
 	count := 0
 	curHead := cubeCell.CellHead
 	dataArr := db.Cube[cubeIndex].DataArr
+	if dataNum == 0 {
+		// a cube without points has no data file
+		return dPoints
+	}
 	if len(dataArr) == 0 {
 		// read File as pointer
-		dataFileName := dbRootPath + strconv.Itoa(cubeIndex) + "/" + strconv.Itoa(cubeIndex) + ".data"
+		dataFileName := cubeFilePath(db.RootPath, cubeIndex, ".data")
 		f, err := os.Open(dataFileName)
 		defer f.Close()
 		check(err)
@@ -188,7 +231,7 @@ func (db *DB) ReadSingle(cubeIndex int, metaIndex int) []DataPoint {
 			nextHead, totalLength, floatNum, intNum, stringNum := getDataHeader(headerData)
 			dArr := make([]byte, totalLength)
 			f.ReadAt(dArr, int64(curHead+20))
-			dPoints[count] = convertByteTodPoint(dArr, floatNum, intNum, stringNum)
+			dPoints[count] = convertByteTodPointColumns(dArr, floatNum, intNum, stringNum, mask)
 			curHead = nextHead
 			count++
 		}
@@ -197,7 +240,7 @@ func (db *DB) ReadSingle(cubeIndex int, metaIndex int) []DataPoint {
 		for count < dataNum {
 			nextHead, totalLength, floatNum, intNum, stringNum := getDataHeader(dataArr[curHead : curHead+20])
 			data := dataArr[uint32(curHead)+20 : uint32(curHead)+20+totalLength]
-			dPoints[count] = convertByteTodPoint(data, floatNum, intNum, stringNum)
+			dPoints[count] = convertByteTodPointColumns(data, floatNum, intNum, stringNum, mask)
 
 			curHead = nextHead
 			count++
@@ -207,41 +250,93 @@ func (db *DB) ReadSingle(cubeIndex int, metaIndex int) []DataPoint {
 
 }
 
+// CellCount returns the number of points in a cell from the cube meta, without reading the points
+func (db *DB) CellCount(cubeIndex int, metaIndex int) int {
+	db.shuffleCube(cubeIndex)
+	db.Cube[cubeIndex].AccessCount++
+	return db.Cube[cubeIndex].Metainfo.CellArr[metaIndex].Count
+}
+
+// CellAggregate returns the precomputed aggregate of FArr column dim in a cell,
+// nil when the cube does not maintain it
+func (db *DB) CellAggregate(cubeIndex int, metaIndex int, dim uint) *Aggregate {
+	db.shuffleCube(cubeIndex)
+	db.Cube[cubeIndex].AccessCount++
+	metaInfo := &db.Cube[cubeIndex].Metainfo
+	for i, d := range metaInfo.AggDims {
+		if d == dim {
+			cell := &metaInfo.CellArr[metaIndex]
+			if len(cell.Aggs) == 0 {
+				return new(Aggregate)
+			}
+			return &cell.Aggs[i]
+		}
+	}
+	return nil
+}
+
+// PeekMeta returns the meta of the cube without caching it or touching its access count,
+// nil when the cube is not stored here
+func (db *DB) PeekMeta(cubeIndex int) *MetaInfo {
+	if cube, exists := db.Cube[cubeIndex]; exists {
+		return &cube.Metainfo
+	}
+	if !db.CubeExists(cubeIndex) {
+		return nil
+	}
+	cube, err := loadMetaFromDisk(db.RootPath, cubeIndex)
+	if err != nil {
+		return nil
+	}
+	return &cube.Metainfo
+}
+
 func (db *DB) ReadBatch(cubeIndex int, metaIndexes []int) []DataPoint {
+	return db.ReadBatchColumns(cubeIndex, metaIndexes, nil)
+}
+
+// ReadBatchColumns reads the cells decoding only the given dims, nil for every dim
+func (db *DB) ReadBatchColumns(cubeIndex int, metaIndexes []int, dims []uint) []DataPoint {
 	dPoints := make([]DataPoint, 0)
 	// check if the dataArr is loaded in memory
 	if _, exists := db.Cube[cubeIndex]; exists {
 		// if the cube's meta is loaded in cache, check if dataArray is loaded
 		if len(db.Cube[cubeIndex].DataArr) == 0 {
-			db.Cube[cubeIndex].loadDataFromDisk(cubeIndex)
+			db.Cube[cubeIndex].loadDataFromDisk(db.RootPath, cubeIndex)
 		}
 	} else {
 		db.shuffleCube(cubeIndex)
-		db.Cube[cubeIndex].loadDataFromDisk(cubeIndex)
+		db.Cube[cubeIndex].loadDataFromDisk(db.RootPath, cubeIndex)
 	}
 	// read batch does not not count for the touch count for cube(redundant in readSingle)
 	for _, metaIndex := range metaIndexes {
-		dPoints = append(dPoints, db.ReadSingle(cubeIndex, metaIndex)...)
+		dPoints = append(dPoints, db.ReadSingleColumns(cubeIndex, metaIndex, dims)...)
 	}
 	return dPoints
 }
 
 func (db *DB) testReadAll(cubeIndex int) {
 	db.shuffleCube(cubeIndex)
-	db.Cube[cubeIndex].loadDataFromDisk(cubeIndex)
+	db.Cube[cubeIndex].loadDataFromDisk(db.RootPath, cubeIndex)
 }
 
 func (db *DB) ReadAll(cubeIndex int) []DataPoint {
+	return db.ReadAllColumns(cubeIndex, nil)
+}
+
+// ReadAllColumns reads the cube decoding only the given dims, nil for every dim
+func (db *DB) ReadAllColumns(cubeIndex int, dims []uint) []DataPoint {
+	mask := maskOfDims(dims)
 	dPoints := make([]DataPoint, 0)
 	// check if the dataArr is loaded in memory
 	if _, exists := db.Cube[cubeIndex]; exists {
 		// if the cube's meta is loaded in cache, check if dataArray is loaded
 		if len(db.Cube[cubeIndex].DataArr) == 0 {
-			db.Cube[cubeIndex].loadDataFromDisk(cubeIndex)
+			db.Cube[cubeIndex].loadDataFromDisk(db.RootPath, cubeIndex)
 		}
 	} else {
 		db.shuffleCube(cubeIndex)
-		db.Cube[cubeIndex].loadDataFromDisk(cubeIndex)
+		db.Cube[cubeIndex].loadDataFromDisk(db.RootPath, cubeIndex)
 	}
 	// convert all data from dataArr
 	// dataFormat: | offset(4bit) | header(| totalLength | FloatNum | IntNum | StringNum |) | data(float|int|string) |
@@ -251,7 +346,7 @@ func (db *DB) ReadAll(cubeIndex int) []DataPoint {
 		startindex += 20
 		_, totalLength, floatNum, intNum, stringNum := getDataHeader(header)
 		dArr := db.Cube[cubeIndex].DataArr[startindex : startindex+totalLength]
-		dPoints = append(dPoints, convertByteTodPoint(dArr, floatNum, intNum, stringNum))
+		dPoints = append(dPoints, convertByteTodPointColumns(dArr, floatNum, intNum, stringNum, mask))
 		startindex += totalLength
 	}
 	// add k% of total length touch count to this cube, initially k is 50%
@@ -311,15 +406,17 @@ func (db *DB) FindReplaceIndex() int {
 // then we need to feed the data from unorganized batch of datapoints to the cube or read data from files
 func (db *DB) CreateMetaCube(cubeId int, cubeSize int, dims []uint, maxs []float64, mins []float64) error {
 	//fmt.Printf("Creating metaCube for index:%d...\n", cubeId)
-	if err := os.MkdirAll(path.Join(dbRootPath, strconv.Itoa(cubeId)), 0700); err != nil {
+	if err := os.MkdirAll(path.Join(db.RootPath, strconv.Itoa(cubeId)), 0700); err != nil {
 		return err
 	}
+	// later feeds of the cube append to it
+	db.CubeMetaMap[cubeId] = cubeFilePath(db.RootPath, cubeId, ".meta")
 	// TODO: Change to sync.pool?
 	// free last MetaCube used
 	// TODO: LRU => current size 1, change randomize replace to be LRU style
 	if len(db.Cube) < cacheSize {
 		db.Cube[cubeId] = &MetaCube{
-			Metainfo:    MetaInfo{CubeIndex: cubeId, Cubesize: cubeSize, CellArr: make([]CubeCell, cubeSize), GlobalOffset: 0, Dims: dims, Maxs: maxs, Mins: mins},
+			Metainfo:    MetaInfo{CubeIndex: cubeId, Cubesize: cubeSize, CellArr: make([]CubeCell, cubeSize), GlobalOffset: 0, Dims: dims, Maxs: maxs, Mins: mins, AggDims: db.CellAggDims, Format: cubeFormat},
 			DataArr:     make([]byte, dataArraySize),
 			AccessCount: 0,
 			InsertTime:  time.Now().Unix()}
@@ -335,11 +432,11 @@ func (db *DB) CreateMetaCube(cubeId int, cubeSize int, dims []uint, maxs []float
 		*/
 		toReplaceIdx := db.FindReplaceIndex()
 		// before delete the entry, write back meta info and data to disk
-		err := db.Cube[toReplaceIdx].writeToDisk()
+		err := db.Cube[toReplaceIdx].writeToDisk(db.RootPath)
 		check(err)
 		delete(db.Cube, toReplaceIdx)
 		db.Cube[cubeId] = &MetaCube{
-			Metainfo:    MetaInfo{CubeIndex: cubeId, Cubesize: cubeSize, CellArr: make([]CubeCell, cubeSize), GlobalOffset: 0, Dims: dims, Maxs: maxs, Mins: mins},
+			Metainfo:    MetaInfo{CubeIndex: cubeId, Cubesize: cubeSize, CellArr: make([]CubeCell, cubeSize), GlobalOffset: 0, Dims: dims, Maxs: maxs, Mins: mins, AggDims: db.CellAggDims, Format: cubeFormat},
 			DataArr:     make([]byte, dataArraySize),
 			AccessCount: 0,
 			InsertTime:  time.Now().Unix()}
@@ -371,17 +468,22 @@ func (db *DB) Feed(batch *DataBatch) error {
 			// this cube data is currently in momery, do append data to cube
 			if len(db.Cube[batch.CubeId].DataArr) == 0 {
 				// if there's no data arr, only metaData exists, load data from disk first
-				db.Cube[batch.CubeId].loadDataFromDisk(batch.CubeId)
+				db.Cube[batch.CubeId].loadDataFromDisk(db.RootPath, batch.CubeId)
 			}
 			db.feedBatchToCube(batch.DPoints, batch.CubeId)
 		} else {
 			// load Cube File from disk
 			// if length is less than cacheSize, just append new
 			if len(db.Cube) < cacheSize {
-				db.Cube[batch.CubeId], _ = loadCubeFromDisk(batch.CubeId)
+				cube, err := loadCubeFromDisk(db.RootPath, batch.CubeId)
+				if err != nil {
+					fmt.Println(err)
+					return err
+				}
+				db.Cube[batch.CubeId] = cube
 			} else {
 				db.shuffleCube(batch.CubeId)
-				db.Cube[batch.CubeId].loadDataFromDisk(batch.CubeId)
+				db.Cube[batch.CubeId].loadDataFromDisk(db.RootPath, batch.CubeId)
 				// find a randomized entry in cube map, load a new MetaCube of this batch index, replace it and then add batch data to it
 				/*
 					indexToReplace := rand.Intn(len(db.Cube))
@@ -396,6 +498,9 @@ func (db *DB) Feed(batch *DataBatch) error {
 		}
 	}
 	//fmt.Printf("After feed, data length of cube %d is %d\n", batch.CubeId, len(db.Cube[batch.CubeId].DataArr))
+	if db.OnFeed != nil {
+		db.OnFeed(batch.CubeId)
+	}
 	return err
 }
 
@@ -409,10 +514,15 @@ func (db *DB) feedBatchToCube(dPoints []DataPoint, cubeIdx int) {
 	}
 }
 
-// loadDataFromDisk load dataArr from disk according to the index of cube
-func (c *MetaCube) loadDataFromDisk(index int) error {
+// File of the cube index under rootPath with the extension ext
+func cubeFilePath(rootPath string, index int, ext string) string {
 	indexString := strconv.Itoa(index)
-	dataPath := dbRootPath + indexString + "/" + indexString + ".data"
+	return path.Join(rootPath, indexString, indexString+ext)
+}
+
+// loadDataFromDisk load dataArr from disk according to the index of cube
+func (c *MetaCube) loadDataFromDisk(rootPath string, index int) error {
+	dataPath := cubeFilePath(rootPath, index, ".data")
 	if _, err := os.Stat(dataPath); err == nil {
 		dataByte, _ := ioutil.ReadFile(dataPath)
 		c.DataArr = append(c.DataArr, dataByte...)
@@ -423,50 +533,62 @@ func (c *MetaCube) loadDataFromDisk(index int) error {
 
 // loadMetaFromDisk load metadata from disk(disgard dataArr), returns a metaCube with metainfo but a length of dataArr
 // of zero, if further need the loading of data, should call loadDataFromDisk
-func loadMetaFromDisk(index int) (*MetaCube, error) {
+func loadMetaFromDisk(rootPath string, index int) (*MetaCube, error) {
 	c := new(MetaCube)
 	c.DataArr = make([]byte, 0)
-	indexString := strconv.Itoa(index)
-	metaPath := dbRootPath + indexString + "/" + indexString + ".meta"
+	metaPath := cubeFilePath(rootPath, index, ".meta")
 	dataByte, err := ioutil.ReadFile(metaPath)
 	err = json.Unmarshal(dataByte, &c.Metainfo)
 	c.InsertTime = time.Now().Unix()
 	c.AccessCount = 0
 	check(err)
+	if err = checkFormat(&c.Metainfo); err != nil {
+		return nil, err
+	}
 	return c, err
 }
 
+// checkFormat returns an error for a cube written in another format than cubeFormat
+func checkFormat(meta *MetaInfo) error {
+	if meta.Format != cubeFormat {
+		return errors.New(fmt.Sprintf("cube %d is in format %d instead of %d, import the data again", meta.CubeIndex, meta.Format, cubeFormat))
+	}
+	return nil
+}
+
 // loadCubeFromDisk load the whole cube include data array and meta data
-func loadCubeFromDisk(index int) (c *MetaCube, err error) {
+func loadCubeFromDisk(rootPath string, index int) (c *MetaCube, err error) {
 	c = new(MetaCube)
-	indexString := strconv.Itoa(index)
-	dataPath := dbRootPath + indexString + "/" + indexString + ".data"
+	dataPath := cubeFilePath(rootPath, index, ".data")
 	var dataByte []byte
 	if _, err := os.Stat(dataPath); err == nil {
 		dataByte, _ = ioutil.ReadFile(dataPath)
-		copy(c.DataArr, dataByte)
+		c.DataArr = dataByte
 	}
 
-	metaPath := dbRootPath + indexString + "/" + indexString + ".meta"
+	metaPath := cubeFilePath(rootPath, index, ".meta")
 	dataByte, err = ioutil.ReadFile(metaPath)
 	err = json.Unmarshal(dataByte, &c.Metainfo)
 	c.InsertTime = time.Now().Unix()
 	c.AccessCount = 0
 	check(err)
+	if err = checkFormat(&c.Metainfo); err != nil {
+		return nil, err
+	}
 	return c, err
 }
 
-func (c *MetaCube) writeToDisk() error {
+func (c *MetaCube) writeToDisk(rootPath string) error {
 	// save data array to be index.data
 	// save the left to be index.meta
 	//fmt.Printf("Writing back cube %d to disk...\n", c.Metainfo.CubeIndex)
 	stringIdx := strconv.Itoa(c.Metainfo.CubeIndex)
 	// create index file dir if not exists, if not, just mkdir
-	if _, err := os.Stat(dbRootPath + stringIdx + "/"); os.IsNotExist(err) {
-		os.Mkdir(dbRootPath+stringIdx+"/", os.ModePerm)
+	if _, err := os.Stat(path.Join(rootPath, stringIdx)); os.IsNotExist(err) {
+		os.MkdirAll(path.Join(rootPath, stringIdx), os.ModePerm)
 	}
-	dataFileName := dbRootPath + stringIdx + "/" + stringIdx + ".data"
-	metaFileName := dbRootPath + stringIdx + "/" + stringIdx + ".meta"
+	dataFileName := cubeFilePath(rootPath, c.Metainfo.CubeIndex, ".data")
+	metaFileName := cubeFilePath(rootPath, c.Metainfo.CubeIndex, ".meta")
 
 	// dump data file
 	if len(c.DataArr) > 0 {
@@ -487,6 +609,14 @@ func (cube *MetaCube) feedCubeCell(p DataPoint) {
 	// c is cube cell
 	c := &cube.Metainfo.CellArr[p.Idx]
 	c.Count++
+	if len(cube.Metainfo.AggDims) > 0 {
+		if len(c.Aggs) == 0 {
+			c.Aggs = make([]Aggregate, len(cube.Metainfo.AggDims))
+		}
+		for i, d := range cube.Metainfo.AggDims {
+			c.Aggs[i].Add(p.getFloatValByDim(d))
+		}
+	}
 	globalOffsetCopy := cube.Metainfo.GlobalOffset
 	//fmt.Printf("GlobalOffset = %d\n", cube.Metainfo.GlobalOffset)
 	TailCopy := c.CellTail
@@ -548,6 +678,7 @@ func (c *MetaCube) readEntry(offset int, length int) (data []byte) {
 }
 
 // Header format: | totalLength | FloatNum | IntNum | StringNum |
+// Data format: floats as 8 bytes, ints as 4 bytes big-endian int32, strings each ended by a tab
 func convertDPoint(d DataPoint) (res []byte, header []byte) {
 	lenFloat := len(d.FArr)
 	if lenFloat > 0 {
@@ -559,7 +690,8 @@ func convertDPoint(d DataPoint) (res []byte, header []byte) {
 	lenInt := len(d.IArr)
 	if lenInt > 0 {
 		for _, iNum := range d.IArr {
-			byteData, _ := json.Marshal(iNum)
+			byteData := make([]byte, 4)
+			binary.BigEndian.PutUint32(byteData, uint32(int32(iNum)))
 			res = append(res, byteData...)
 		}
 	}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// A cube written back to disk and dropped from memory keeps its points and takes later feeds
+func TestCubeDiskRoundTrip(t *testing.T) {
+	t.Chdir(t.TempDir())
+	dTree := InitTree([]uint{0, 1}, []uint{2, 2}, 2, []float64{0, 0}, []float64{1, 1})
+	node := &dTree.Nodes[0]
+	points := []DataPoint{
+		{FArr: []float64{0.1, 0.2}, IArr: []int{7}, SArr: []string{"a"}},
+		{FArr: []float64{0.8, 0.9}, IArr: []int{-12345}, SArr: []string{"bc"}},
+		{FArr: []float64{0.6, 0.3}, IArr: []int{0}, SArr: []string{"def"}},
+	}
+	db, _ := InitDB()
+	for i, dp := range points {
+		if i == 2 {
+			// evict the cube as shuffleCube does
+			if err := db.Cube[0].writeToDisk(db.RootPath); err != nil {
+				t.Fatal(err)
+			}
+			delete(db.Cube, 0)
+		}
+		batch := DataBatch{0, node.Capacity, node.Dims, node.Mins, node.Maxs, []DataPoint{dp}}
+		if err := db.Feed(&batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := db.ReadAll(0)
+	sort.Slice(got, func(i, j int) bool { return got[i].FArr[0] < got[j].FArr[0] })
+	want := []DataPoint{points[0], points[2], points[1]}
+	if len(got) != len(want) {
+		t.Fatalf("got %d points, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i].FArr, want[i].FArr) || !reflect.DeepEqual(got[i].IArr, want[i].IArr) || !reflect.DeepEqual(got[i].SArr, want[i].SArr) {
+			t.Fatalf("point %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// A cube written before the current data format is refused instead of decoded wrongly
+func TestFeedOldFormatCube(t *testing.T) {
+	t.Chdir(t.TempDir())
+	dTree := InitTree([]uint{0, 1}, []uint{2, 2}, 2, []float64{0, 0}, []float64{1, 1})
+	node := &dTree.Nodes[0]
+	db, _ := InitDB()
+	batch := DataBatch{0, node.Capacity, node.Dims, node.Mins, node.Maxs, []DataPoint{{FArr: []float64{0.1, 0.2}, IArr: []int{7}}}}
+	if err := db.Feed(&batch); err != nil {
+		t.Fatal(err)
+	}
+	db.Cube[0].Metainfo.Format = 0
+	if err := db.Cube[0].writeToDisk(db.RootPath); err != nil {
+		t.Fatal(err)
+	}
+	delete(db.Cube, 0)
+	if err := db.Feed(&batch); err == nil {
+		t.Fatal("fed a cube of an old format")
+	}
+	if db.PeekMeta(0) != nil {
+		t.Fatal("peeked the meta of a cube of an old format")
+	}
+}
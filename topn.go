@@ -0,0 +1,141 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The best points of a top-N query, best first, with their values of the order column
+type TopN struct {
+	Points []DataPoint
+	Values []float64
+}
+
+// Merge the points of other, keeping the n best
+func (top *TopN) Merge(other *TopN, n int, descending bool) {
+	points := append(append([]DataPoint{}, top.Points...), other.Points...)
+	values := append(append([]float64{}, top.Values...), other.Values...)
+	merged := byDistance{points, values}
+	if descending {
+		sort.Stable(sort.Reverse(merged))
+	} else {
+		sort.Stable(merged)
+	}
+	if len(points) > n {
+		points, values = points[:n], values[:n]
+	}
+	top.Points, top.Values = points, values
+}
+
+// A cell of the region with the bound of its best value
+type topNCell struct {
+	cubeInd int
+	metaInd int
+	partial bool
+	bound   float64
+}
+
+/*
+Upper bound of sign * value of dim over the points of the cell, -Inf for an empty cell
+The per-cell aggregate of dim gives the exact bound, otherwise the cell box when dim is
+a dim of the tree
+*/
+func (worker *Worker) topNBound(node *DTreeNode, cubeInd int, metaInd int, dim uint, sign float64) float64 {
+	if agg := worker.db.CellAggregate(cubeInd, metaInd, dim); agg != nil {
+		if agg.Count == 0 {
+			return math.Inf(-1)
+		} else if sign > 0 {
+			return agg.Max
+		}
+		return -agg.Min
+	}
+	if worker.db.CellCount(cubeInd, metaInd) == 0 {
+		return math.Inf(-1)
+	}
+	for i, d := range node.Dims {
+		if d == dim {
+			cellMins, cellMaxs, _ := node.Boundary(metaInd)
+			if sign > 0 {
+				return cellMaxs[i]
+			}
+			return -cellMins[i]
+		}
+	}
+	return math.Inf(1)
+}
+
+/*
+Return the query.K points of the region with the highest, or lowest, values of the FArr
+column query.OrderDim, on the cubes owned by this worker
+Cells are read best bound first into a bounded heap, and the search stops at the first
+cell that cannot beat the worst point kept
+*/
+func (worker *Worker) TopNQuery(query *Query) (*TopN, error) {
+	if err := query.ValidateTopN(); err != nil {
+		return nil, err
+	}
+	cubeInds, err := worker.dTree.RegionSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	sign := float64(-1)
+	if query.Descending {
+		sign = 1
+	}
+	var cells []topNCell
+	for _, cubeInd := range cubeInds {
+		if worker.cubeList[cubeInd] != worker.id {
+			continue
+		}
+		node := &worker.dTree.Nodes[cubeInd]
+		insideInds, partialInds := node.RegionCells(query)
+		for i, metaInds := range [][]int{insideInds, partialInds} {
+			for _, metaInd := range metaInds {
+				bound := worker.topNBound(node, cubeInd, metaInd, query.OrderDim, sign)
+				if !math.IsInf(bound, -1) {
+					cells = append(cells, topNCell{cubeInd, metaInd, i == 1, bound})
+				}
+			}
+		}
+	}
+	sort.SliceStable(cells, func(i, j int) bool { return cells[i].bound > cells[j].bound })
+
+	// min heap of sign * value, the worst point kept on top
+	bestPQ := new(PQKNNPoints)
+	bestPQ.points = make([]*KNNPoint, 0, query.K)
+	decodeDims := query.decodeDims([]uint{query.OrderDim})
+	for _, cell := range cells {
+		if bestPQ.Len() == query.K && cell.bound <= bestPQ.points[0].distance {
+			break
+		}
+		for _, dp := range worker.db.ReadBatchColumns(cell.cubeInd, []int{cell.metaInd}, decodeDims) {
+			if cell.partial && !query.CheckRegion(&dp) {
+				continue
+			}
+			if dp.getKindByDim(query.OrderDim) != 0 {
+				err := errors.New(fmt.Sprintf("Order dim %d is not a float column", query.OrderDim))
+				return nil, err
+			}
+			key := sign * dp.getFloatValByDim(query.OrderDim)
+			if bestPQ.Len() < query.K {
+				point := dp
+				heap.Push(bestPQ, &KNNPoint{distance: key, dPoint: &point})
+			} else if key > bestPQ.points[0].distance {
+				point := dp
+				bestPQ.points[0] = &KNNPoint{distance: key, dPoint: &point}
+				heap.Fix(bestPQ, 0)
+			}
+		}
+	}
+
+	top := &TopN{Points: make([]DataPoint, bestPQ.Len()), Values: make([]float64, bestPQ.Len())}
+	for i := bestPQ.Len() - 1; i >= 0; i-- {
+		best := heap.Pop(bestPQ).(*KNNPoint)
+		top.Points[i] = query.Project(best.dPoint)
+		top.Values[i] = sign * best.distance
+	}
+	return top, nil
+}
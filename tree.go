@@ -138,13 +138,25 @@ func mapInd1d(x, xmin, cell float64) int {
 	return int(math.Floor((x - xmin) / cell))
 }
 
+// Grid index of value v on the i-th dim of the node
+// Values on the max edge (or pushed over by rounding) are kept in the last cell
+func (node *DTreeNode) gridInd1d(i int, v float64) int {
+	ind := mapInd1d(v, node.Mins[i], node.CellVals[i])
+	if ind >= int(node.DCaps[i]) {
+		ind = int(node.DCaps[i]) - 1
+	} else if ind < 0 {
+		ind = 0
+	}
+	return ind
+}
+
 func (node *DTreeNode) MapInd(point *DataPoint) int {
 
 	ind := 0
 	for i, d := range node.Dims {
 		v := point.getFloatValByDim(d)
 		ind *= int(node.DCaps[i])
-		ind += mapInd1d(v, node.Mins[i], node.CellVals[i])
+		ind += node.gridInd1d(i, v)
 	}
 	point.Idx = ind
 	return ind
@@ -158,7 +170,7 @@ func (node *DTreeNode) MapIndByVal(queryDims []uint, queryDimVals []float64) (in
 		for i, v := range queryDimVals {
 			ind *= int(node.DCaps[i])
 			//fmt.Printf("Ind %d, diff %f, cell %f\n", mapInd1d(v, node.Mins[i], node.CellVals[i]), v-node.Mins[i], node.CellVals[i])
-			ind += mapInd1d(v, node.Mins[i], node.CellVals[i])
+			ind += node.gridInd1d(i, v)
 		}
 		return ind, nil
 	}
@@ -177,7 +189,7 @@ func (node *DTreeNode) MapIndByVal(queryDims []uint, queryDimVals []float64) (in
 			return -1, err
 		}
 		ind *= int(node.DCaps[i])
-		ind += mapInd1d(v, node.Mins[i], node.CellVals[i])
+		ind += node.gridInd1d(i, v)
 	}
 	return ind, nil
 }
@@ -201,100 +213,204 @@ func (node *DTreeNode) FixValueOrder(queryDims []uint, queryDimVals []float64) (
 	return val, nil
 }
 
+/*
+Decode the meta index into the grid index of each dimension
+MapInd encodes in mixed radix with node.Dims[0] as the most significant digit,
+so the decoding peels the digits off from the last dimension
+*/
+func (node *DTreeNode) MetaInd2GridInd(metaInd int) ([]int, error) {
+	if metaInd < 0 || metaInd >= int(node.Capacity) {
+		err := errors.New(fmt.Sprintf("Meta index %d out of range [0, %d)", metaInd, node.Capacity))
+		fmt.Println(err)
+		return nil, err
+	}
+	gridIndices := make([]int, len(node.DCaps))
+	for i := len(node.DCaps) - 1; i >= 0; i-- {
+		gridIndices[i] = metaInd % int(node.DCaps[i])
+		metaInd /= int(node.DCaps[i])
+	}
+	return gridIndices, nil
+}
+
+// Inverse of MetaInd2GridInd
+func (node *DTreeNode) GridInd2MetaInd(gridIndices []int) (int, error) {
+	if len(gridIndices) != len(node.DCaps) {
+		err := errors.New(fmt.Sprintf("Grid index has %d dims, node has %d", len(gridIndices), len(node.DCaps)))
+		fmt.Println(err)
+		return -1, err
+	}
+	ind := 0
+	for i, g := range gridIndices {
+		if g < 0 || g >= int(node.DCaps[i]) {
+			err := errors.New(fmt.Sprintf("Grid index %d on dim %d exceeds capacity %d", g, node.Dims[i], node.DCaps[i]))
+			fmt.Println(err)
+			return -1, err
+		}
+		ind *= int(node.DCaps[i])
+		ind += g
+	}
+	return ind, nil
+}
+
+// Return the min and max values of the specified cubecell, in node.Dims' order
+func (node *DTreeNode) Boundary(metaInd int) ([]float64, []float64, error) {
+	dimIndices, err := node.MetaInd2GridInd(metaInd)
+	if err != nil {
+		return nil, nil, err
+	}
+	vals := make([]float64, len(node.Mins))
+	vals2 := make([]float64, len(node.Mins))
+	for i, m := range node.Mins {
+		vals[i] = m + (float64(dimIndices[i]))*node.CellVals[i]
+		vals2[i] = m + (float64(dimIndices[i])+1)*node.CellVals[i]
+	}
+	return vals, vals2, nil
+}
+
+/*
+Return the cells touching the specified cubecell, including only touching at a corner,
+as (cube index, meta index) pairs. Neighbours in the same node are the cells at most one
+grid step away, a cell on the edge of the node also touches the cells of the other leaf
+nodes across that edge, whose grids are not aligned with this one
+*/
+func (dTree *DTree) NeighborCells(cubeInd int, metaInd int) ([][2]int, error) {
+	node := &dTree.Nodes[cubeInd]
+	gridInd, err := node.MetaInd2GridInd(metaInd)
+	if err != nil {
+		return nil, err
+	}
+	lows, highs, _ := node.Boundary(metaInd)
+	lo := make([]int, len(gridInd))
+	hi := make([]int, len(gridInd))
+	onEdge := false
+	for k, g := range gridInd {
+		lo[k], hi[k] = g-1, g+1
+		if lo[k] < 0 {
+			// node bounds are shared exactly with the neighbour nodes
+			lo[k], lows[k], onEdge = 0, node.Mins[k], true
+		}
+		if hi[k] > int(node.DCaps[k])-1 {
+			hi[k], highs[k], onEdge = int(node.DCaps[k])-1, node.Maxs[k], true
+		}
+	}
+	neighbors := make([][2]int, 0)
+	for _, ind := range node.MetaIndsInGridRange(lo, hi) {
+		if ind != metaInd {
+			neighbors = append(neighbors, [2]int{cubeInd, ind})
+		}
+	}
+	if !onEdge {
+		return neighbors, nil
+	}
+	leafInds, err := dTree.BoxSearch(lows, highs)
+	if err != nil {
+		return nil, err
+	}
+	for _, leafInd := range leafInds {
+		if leafInd == cubeInd {
+			continue
+		}
+		leaf := &dTree.Nodes[leafInd]
+		leafLo, leafHi, overlap := leaf.GridRange(lows, highs)
+		if !overlap {
+			continue
+		}
+		for _, ind := range leaf.MetaIndsInGridRange(leafLo, leafHi) {
+			neighbors = append(neighbors, [2]int{leafInd, ind})
+		}
+	}
+	return neighbors, nil
+}
+
+/*
+Grid index range [lo, hi] of the cells overlapping the box [mins, maxs],
+in node.Dims' order. Return false if the box does not overlap the node
+*/
+func (node *DTreeNode) GridRange(mins []float64, maxs []float64) ([]int, []int, bool) {
+	lo := make([]int, len(node.Dims))
+	hi := make([]int, len(node.Dims))
+	for i := range node.Dims {
+		if maxs[i] < node.Mins[i] || mins[i] > node.Maxs[i] {
+			return nil, nil, false
+		}
+		lo[i] = node.gridInd1d(i, math.Max(mins[i], node.Mins[i]))
+		hi[i] = node.gridInd1d(i, math.Min(maxs[i], node.Maxs[i]))
+	}
+	return lo, hi, true
+}
+
+// Meta indices of all the cells in grid index range [lo, hi]
+func (node *DTreeNode) MetaIndsInGridRange(lo []int, hi []int) []int {
+	metaInds := make([]int, 0)
+	gridInd := make([]int, len(lo))
+	copy(gridInd, lo)
+	for {
+		metaInd, _ := node.GridInd2MetaInd(gridInd)
+		metaInds = append(metaInds, metaInd)
+		// increase like an odometer, last dim first
+		k := len(gridInd) - 1
+		for ; k >= 0; k-- {
+			if gridInd[k] < hi[k] {
+				gridInd[k]++
+				break
+			}
+			gridInd[k] = lo[k]
+		}
+		if k < 0 {
+			return metaInds
+		}
+	}
+}
+
 // Given a node, return the corners of the node
 func (node *DTreeNode) Corners(metaInd int) ([][]float64, error) {
 	// The first dim of corners specify each corner
 	// The second dim specifies the dimension of each value
 	// Consistent to node.Dims' order
-	corners := make([][]float64, int(math.Pow(2, float64(len(node.Dims)))))
+	corners := make([][]float64, 1<<uint(len(node.Dims)))
+	var lows, highs []float64
 	if metaInd < 0 {
 		/*
 			Return the corners of this MetaCube
 		*/
-		for i := range corners {
-			corners[i] = make([]float64, len(node.Dims))
-			j := i
-			for k := range node.Dims {
-				if j%2 == 0 { //min corner of that dim
-					corners[i][k] = node.Mins[k]
-				} else { //max corner of that dim
-					corners[i][k] = node.Maxs[k]
-				}
-				j /= 2
-			}
-		}
+		lows, highs = node.Mins, node.Maxs
 	} else {
 		/*
 			Return the corners of the specified cubecell
 		*/
-		dimIndices, err := node.MetaInd2GridInd(metaInd)
+		var err error
+		lows, highs, err = node.Boundary(metaInd)
 		if err != nil {
 			return nil, err
 		}
-		vals := make([]float64, 2)
-		for i, m := range node.Mins {
-			vals[i] = m + float64(dimIndices[i])*node.CellVals[i]
-		}
-		for i := range corners {
-			corners[i] = make([]float64, len(node.Dims))
-			j := i
-			for k := range node.Dims {
-				if j%2 == 0 { //min corner of that dim
-					corners[i][k] = vals[k]
-				} else { //max corner of that dim
-					corners[i][k] = vals[k] + node.CellVals[k]
-				}
-				j /= 2
+	}
+	for i := range corners {
+		corners[i] = make([]float64, len(node.Dims))
+		j := i
+		for k := range node.Dims {
+			if j%2 == 0 { //min corner of that dim
+				corners[i][k] = lows[k]
+			} else { //max corner of that dim
+				corners[i][k] = highs[k]
 			}
+			j /= 2
 		}
 	}
 	return corners, nil
 }
 
-/*
-Note! Only works for 2 dimension index, 3d is not recoverable for general DCaps
-REQUIRE: DCaps values to be distinguish prime number for higher dimension
-*/
-func (node *DTreeNode) MetaInd2GridInd(metaInd int) ([]int, error) {
-	if len(node.Dims) > 2 {
-		err := errors.New(fmt.Sprintf("Higher dimension %d is not recoverable unless prime dCaps", len(node.Dims)))
-		fmt.Println(err)
-		return nil, err
-	}
-	//Hard Code for 2D
-	highDimIndices := make([]int, 2)
-	highDimIndices[0] = metaInd / int(node.DCaps[0])
-	highDimIndices[1] = metaInd % int(node.DCaps[0])
-	return highDimIndices, nil
-}
-
 func (node *DTreeNode) GetRoughMiddlePoint(metaInd int) ([]float64, error) {
 	dimIndices, err := node.MetaInd2GridInd(metaInd)
 	if err != nil {
 		return nil, err
 	}
-	vals := make([]float64, 2)
+	vals := make([]float64, len(node.Mins))
 	for i, m := range node.Mins {
 		vals[i] = m + (float64(dimIndices[i])+0.5)*node.CellVals[i]
 	}
 	return vals, nil
 }
 
-func (node *DTreeNode) Boundary(metaInd int) ([]float64, []float64, error) {
-	dimIndices, err := node.MetaInd2GridInd(metaInd)
-	if err != nil {
-		return nil, nil, err
-	}
-	vals := make([]float64, 2)
-	vals2 := make([]float64, 2)
-	for i, m := range node.Mins {
-		vals[i] = m + (float64(dimIndices[i]))*node.CellVals[i]
-		vals2[i] = m + (float64(dimIndices[i])+1)*node.CellVals[i]
-	}
-	fmt.Println(node.CellVals)
-	return vals, vals2, nil
-}
-
 // Given a central position, return the constrain point on the boundary line
 // datapoint is assumed to have same dim info as node
 func (node *DTreeNode) BoundaryConstrain(dataDimVals []float64, metaInd int) ([][]float64, error) {
@@ -329,14 +445,10 @@ func (node *DTreeNode) BoundaryConstrain(dataDimVals []float64, metaInd int) ([]
 
 	} else {
 		//Return the boundary values in the specified cubecell
-		dimIndices, err := node.MetaInd2GridInd(metaInd)
+		vals, vals2, err := node.Boundary(metaInd)
 		if err != nil {
 			return nil, err
 		}
-		vals := make([]float64, len(node.Mins))
-		for i, m := range node.Mins {
-			vals[i] = m + float64(dimIndices[i])*node.CellVals[i]
-		}
 		for i, _ := range constrainPoints {
 			constrainPoints[i] = make([]float64, len(node.Dims))
 			copy(constrainPoints[i], dataDimVals)
@@ -344,13 +456,13 @@ func (node *DTreeNode) BoundaryConstrain(dataDimVals []float64, metaInd int) ([]
 			if i%2 == 0 {
 				constrainPoints[i][dim] = vals[dim]
 			} else {
-				constrainPoints[i][dim] = vals[dim] + node.CellVals[dim]
+				constrainPoints[i][dim] = vals2[dim]
 			}
 			// CheckRange and remove out of range points(yes, points are either on the boundary
 			// or out of boundary)
 			withinRange := true
 			for j, v := range constrainPoints[i] {
-				if v < vals[j] || v > (vals[j]+node.CellVals[j]) {
+				if v < vals[j] || v > vals2[j] {
 					//fmt.Printf("Drop v: %.17f, min %.17f, max %.17f\n", v, vals[j], vals[j]+node.CellVals[j])
 					//fmt.Printf("cell: %.17f, node min %.17f, node max %.17f\n", node.CellVals[j], node.Mins[j], node.Maxs[j])
 					withinRange = false
@@ -365,34 +477,6 @@ func (node *DTreeNode) BoundaryConstrain(dataDimVals []float64, metaInd int) ([]
 	return outputPoints, nil
 }
 
-// Return False immediately if any requirement is not satisfied to save time
-// Query Operations in each dim: 0 =; 1 >; -1 <, etc
-func (node *DTreeNode) RangeCheck(queryDimVals []float64, queryDimOpts []int, qDict map[uint][]int) bool {
-	//fmt.Println(qDict)
-	for d, dim := range node.Dims {
-		if _, exists := qDict[dim]; !exists {
-			// Skip this dimension (satisfied)
-			continue
-		}
-		for _, qInd := range qDict[dim] {
-			if queryDimOpts[qInd] == 0 {
-				if queryDimVals[qInd] < node.Mins[d] || queryDimVals[qInd] > node.Maxs[d] {
-					//fmt.Printf("fail condition 1, on dim %d\n", dim)
-					//fmt.Printf("dim: %d, val %f, min %f, max %f\n", dim, queryDimVals[qInd], node.Mins[d], node.Maxs[d])
-					return false
-				}
-			} else if queryDimOpts[qInd] < 0 && queryDimVals[qInd] < node.Mins[d] {
-				//fmt.Printf("fail condition 2, on dim %d\n", dim)
-				return false
-			} else if queryDimVals[qInd] > node.Maxs[d] {
-				//fmt.Printf("fail condition 3, on dim %d\n", dim)
-				return false
-			}
-		}
-	}
-	return true
-}
-
 type DTree struct {
 	Nodes    []DTreeNode
 	NodeData [][]DataPoint
@@ -508,11 +592,9 @@ func (dTree *DTree) DiscreteEntropy(splitNodeInd uint, useHeuristic uint) (bestS
 			columnCount[i] = 0
 		}
 
-		xmin := dTree.Nodes[splitNodeInd].Mins[j]
-		cell := dTree.Nodes[splitNodeInd].CellVals[j]
 		for _, data := range dTree.NodeData[splitNodeInd] {
 			val := data.getFloatValByDim(d)
-			columnCount[mapInd1d(val, xmin, cell)] += 1
+			columnCount[dTree.Nodes[splitNodeInd].gridInd1d(j, val)] += 1
 		}
 		totalCount := float64(len(dTree.NodeData[splitNodeInd]))
 		entropies[j] = float64(0)
@@ -729,62 +811,155 @@ func (dTree *DTree) EquatlitySearch(queryDims []uint, queryDimVals []float64) ([
 // Find all related tree nodes
 // Retrun the indices of node
 func (dTree *DTree) RangeSearch(queryDims []uint, queryDimVals []float64, queryDimOpts []int) ([]int, error) {
-	//remove dimensions not used in tree spliting
-	//fmt.Println(queryDims)
-	//fmt.Println(queryDimVals)
-	var qDims []uint
-	var qDimVals []float64
-	var qDimOpts []int
+	return dTree.PredicateSearch(flatPredicate(queryDims, queryDimVals, queryDimOpts))
+}
 
-	var dict map[uint]bool
-	dict = make(map[uint]bool, 4)
-	for _, d := range dTree.Dims {
-		dict[d] = true
+// Find all leaf nodes that may contain points satisfying the predicate
+// Retrun the indices of node
+func (dTree *DTree) PredicateSearch(pred *Predicate) ([]int, error) {
+	finalNodeList, _, err := dTree.PredicateSearchTrace(pred)
+	return finalNodeList, err
+}
+
+// PredicateSearch also returning the indices of every node visited, pruned ones included
+func (dTree *DTree) PredicateSearchTrace(pred *Predicate) ([]int, []int, error) {
+	if err := pred.Validate(); err != nil {
+		return nil, nil, err
+	}
+	finalNodeList := make([]int, 0)
+	visitedList := make([]int, 0)
+	currList := []int{}
+	nextList := make([]int, 1)
+	nextList[0] = 0
+	// find the list of related leaf nodes
+	for len(nextList) > 0 {
+		currList = nextList
+		nextList = make([]int, 0)
+		for _, nodeInd := range currList {
+			node := &dTree.Nodes[nodeInd]
+			visitedList = append(visitedList, nodeInd)
+			if pred.BoxCheck(node.Dims, node.Mins, node.Maxs) == boxOutside {
+				continue
+			}
+			if node.IsLeaf {
+				finalNodeList = append(finalNodeList, nodeInd)
+			} else {
+				nextList = append(nextList, int(node.LInd))
+				nextList = append(nextList, int(node.RInd))
+			}
+		}
 	}
 
-	for i, qD := range queryDims {
-		if _, exists := dict[qD]; exists {
-			qDims = append(qDims, qD)
-			qDimVals = append(qDimVals, queryDimVals[i])
-			qDimOpts = append(qDimOpts, queryDimOpts[i])
+	return finalNodeList, visitedList, nil
+}
+
+// Indices of the nodes on the path from the root to nodeInd, nil when not found
+func (dTree *DTree) PathTo(nodeInd int) []int {
+	var search func(curr int) []int
+	search = func(curr int) []int {
+		if curr == nodeInd {
+			return []int{curr}
 		}
+		node := &dTree.Nodes[curr]
+		if node.IsLeaf {
+			return nil
+		}
+		for _, child := range []int{int(node.LInd), int(node.RInd)} {
+			if path := search(child); path != nil {
+				return append([]int{curr}, path...)
+			}
+		}
+		return nil
 	}
+	return search(0)
+}
 
-	// map from search dimension to ARRAY OF INDEX
-	var qDict map[uint][]int
-	qDict = make(map[uint][]int, 4)
-	for i, qD := range qDims {
-		if _, exists := qDict[qD]; exists {
-			qDict[qD] = append(qDict[qD], i)
-		} else {
-			qDict[qD] = make([]int, 0)
-			qDict[qD] = append(qDict[qD], i)
+// Find all leaf nodes within radius of center, values ordered by dTree.Dims
+// Retrun the indices of node
+func (dTree *DTree) RadiusSearch(center []float64, radius float64, metric DistanceMetric) ([]int, error) {
+	if len(center) != len(dTree.Dims) {
+		err := errors.New(fmt.Sprintf("Center has %d dims, tree has %d", len(center), len(dTree.Dims)))
+		fmt.Println(err)
+		return nil, err
+	}
+	finalNodeList := make([]int, 0)
+	currList := []int{}
+	nextList := []int{0}
+	for len(nextList) > 0 {
+		currList = nextList
+		nextList = make([]int, 0)
+		for _, nodeInd := range currList {
+			node := &dTree.Nodes[nodeInd]
+			if metric.LowerBound(center, node.Mins, node.Maxs) > radius {
+				continue
+			}
+			if node.IsLeaf {
+				finalNodeList = append(finalNodeList, nodeInd)
+			} else {
+				nextList = append(nextList, int(node.LInd))
+				nextList = append(nextList, int(node.RInd))
+			}
 		}
 	}
+	return finalNodeList, nil
+}
 
+// Find all leaf nodes whose box on (xDim, yDim) intersects the polygon
+// Retrun the indices of node
+func (dTree *DTree) PolygonSearch(poly *Polygon, xDim uint, yDim uint) ([]int, error) {
+	xInd, yInd, err := polygonDimInds(dTree.Dims, xDim, yDim)
+	if err != nil {
+		return nil, err
+	}
 	finalNodeList := make([]int, 0)
 	currList := []int{}
-	nextList := make([]int, 1)
-	nextList[0] = 0
-	// find the list of related leaf nodes
+	nextList := []int{0}
 	for len(nextList) > 0 {
-		//fmt.Printf("before: current list length %d, next list length %d\n", len(currList), len(nextList))
 		currList = nextList
 		nextList = make([]int, 0)
 		for _, nodeInd := range currList {
-			if dTree.Nodes[nodeInd].RangeCheck(qDimVals, qDimOpts, qDict) {
-				//fmt.Printf("Pass Range check for node index %d\n", nodeInd)
-				if dTree.Nodes[nodeInd].IsLeaf {
-					finalNodeList = append(finalNodeList, nodeInd)
-				} else {
-					nextList = append(nextList, int(dTree.Nodes[nodeInd].LInd))
-					nextList = append(nextList, int(dTree.Nodes[nodeInd].RInd))
-				}
+			node := &dTree.Nodes[nodeInd]
+			if poly.BoxRelation(node.Mins[xInd], node.Mins[yInd], node.Maxs[xInd], node.Maxs[yInd]) == boxOutside {
+				continue
+			}
+			if node.IsLeaf {
+				finalNodeList = append(finalNodeList, nodeInd)
+			} else {
+				nextList = append(nextList, int(node.LInd))
+				nextList = append(nextList, int(node.RInd))
 			}
 		}
-		//fmt.Printf("after: currentlist length %d, nextlist length %d\n", len(currList), len(nextList))
 	}
+	return finalNodeList, nil
+}
 
+// Find all leaf nodes overlapping the box [mins, maxs], values ordered by dTree.Dims
+// Retrun the indices of node
+func (dTree *DTree) BoxSearch(mins []float64, maxs []float64) ([]int, error) {
+	if len(mins) != len(dTree.Dims) || len(maxs) != len(dTree.Dims) {
+		err := errors.New(fmt.Sprintf("Box has %d and %d dims, tree has %d", len(mins), len(maxs), len(dTree.Dims)))
+		fmt.Println(err)
+		return nil, err
+	}
+	finalNodeList := make([]int, 0)
+	currList := []int{}
+	nextList := []int{0}
+	for len(nextList) > 0 {
+		currList = nextList
+		nextList = make([]int, 0)
+		for _, nodeInd := range currList {
+			node := &dTree.Nodes[nodeInd]
+			if _, _, overlap := node.GridRange(mins, maxs); !overlap {
+				continue
+			}
+			if node.IsLeaf {
+				finalNodeList = append(finalNodeList, nodeInd)
+			} else {
+				nextList = append(nextList, int(node.LInd))
+				nextList = append(nextList, int(node.RInd))
+			}
+		}
+	}
 	return finalNodeList, nil
 }
 
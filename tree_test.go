@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+// Corners, GetRoughMiddlePoint and BoundaryConstrain on a cell of a 3D node
+func TestCellGeometryNDim(t *testing.T) {
+	dTree := InitTree([]uint{0, 1, 2}, []uint{4, 4, 4}, 2, testMins, testMaxs)
+	node := &dTree.Nodes[0]
+	metaInd := 21
+	lows, highs, err := node.Boundary(metaInd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corners, err := node.Corners(metaInd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corners) != 8 {
+		t.Fatalf("got %d corners, want 8", len(corners))
+	}
+	for i, corner := range corners {
+		for k := range corner {
+			if want := [2]float64{lows[k], highs[k]}[i>>uint(k)&1]; corner[k] != want {
+				t.Fatalf("corner %d is %v on dim %d, want %v", i, corner[k], k, want)
+			}
+		}
+	}
+	middle, err := node.GetRoughMiddlePoint(metaInd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range middle {
+		if middle[k] <= lows[k] || middle[k] >= highs[k] {
+			t.Fatalf("middle %v outside the cell on dim %d", middle, k)
+		}
+	}
+	// every face of the cell holds the projection of its middle
+	points, err := node.BoundaryConstrain(middle, metaInd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 6 {
+		t.Fatalf("got %d boundary points, want 6", len(points))
+	}
+}
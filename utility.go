@@ -24,11 +24,18 @@ type DataPoint struct {
 }
 
 type Message struct {
-	Type      string //Tree/DataBatch/DataPoints/Query/Error/PeerRequestAll/PeerRequestBatch
+	Type      string //Tree/DataBatch/JoinTree/JoinDataBatch/DataPoints/Aggregate/JoinPairs/Page/Plan/Query/QueryBatch/BatchResults/CacheStats/Error/PeerRequestAll/PeerRequestBatch
 	MsgBytes  []byte
 	CubeIndex []int
 	MetaIndex []int
 	SenderID  int
+	QueryID   int
+	// Achieved error bound of an approximate KNN result, -1 when unbounded
+	ErrorBound float64 `json:",omitempty"`
+	// Cursor of the next page of a paginated query, empty for the last page
+	Cursor string `json:",omitempty"`
+	// Dims to decode for PeerRequestAll, empty for every dim
+	Columns []uint `json:",omitempty"`
 }
 
 type DataBatch struct {
@@ -44,6 +51,31 @@ func (point *DataPoint) getFloatValByDim(d uint) float64 {
 	return point.FArr[d]
 }
 
+// Values of the point on dims, in the same order
+func (point *DataPoint) getFloatValsByDims(dims []uint) []float64 {
+	vals := make([]float64, len(dims))
+	for i, d := range dims {
+		vals[i] = point.FArr[d]
+	}
+	return vals
+}
+
+// Kind of the value on dim d: 0 float, 1 int, 2 string, -1 not exist
+func (point *DataPoint) getKindByDim(d uint) int {
+	if d < uint(len(point.FArr)) {
+		return 0
+	}
+	d = d - uint(len(point.FArr))
+	if d < uint(len(point.IArr)) {
+		return 1
+	}
+	d = d - uint(len(point.IArr))
+	if d < uint(len(point.SArr)) {
+		return 2
+	}
+	return -1
+}
+
 func (point *DataPoint) getIntValByDim(d uint) int {
 	d = d - uint(len(point.FArr))
 	return point.IArr[d]
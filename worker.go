@@ -6,10 +6,13 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 )
@@ -38,6 +41,10 @@ type Worker struct {
 	clientInfo     peerInfo
 	db             *DB
 	peerChan       chan []byte
+	results        *ResultCache
+	// dataset joined by QueryType = 11, held whole by every worker, nil tree until loaded
+	joinTree *DTree
+	joinDB   *DB
 }
 
 //InitWorker ...
@@ -55,6 +62,12 @@ func InitWorker() (w *Worker, err error) {
 	if err != nil {
 		panic(err)
 	}
+	// trip_distance, total_amount and tip
+	tempdb.CellAggDims = []uint{4, 5, 6}
+	joindb, err := InitDBAt(joinDBRootPath)
+	if err != nil {
+		panic(err)
+	}
 
 	idip := map[int]string{1: "172.22.154.227", 2: "172.22.156.227", 3: "172.22.158.227",
 		4: "172.22.154.228", 5: "172.22.156.228", 6: "172.22.158.228",
@@ -71,10 +84,13 @@ func InitWorker() (w *Worker, err error) {
 		cubeList:       make(map[int]int),
 		clientListener: clientConn,
 		db:             tempdb,
+		joinDB:         joindb,
 		clientInfo:     peerInfo{id: 1, address: net.TCPAddr{IP: net.ParseIP(idip[1]), Port: tcpClientListenerPort}},
 		peerChan:       make(chan []byte),
 		peerConn:       peermsgconn,
+		results:        InitResultCache(resultCacheEntries, resultCachePoints),
 	}
+	tempdb.OnFeed = w.results.Invalidate
 
 	for i := 0; i < 14; i++ {
 		if i != w.id {
@@ -116,6 +132,7 @@ func (w *Worker) HandleClientRequests(client net.Conn) {
 	switch msg.Type {
 	case "Tree":
 		w.dTree = UnMarshalTree(msg.MsgBytes)
+		w.results.Clear()
 		log.Println("Finish updating tree")
 		w.Split()
 	case "DataBatch":
@@ -126,9 +143,38 @@ func (w *Worker) HandleClientRequests(client net.Conn) {
 		}
 
 		w.db.Feed(&databatch)
+	case "JoinTree":
+		// the cubes of a previous join dataset are stale
+		os.RemoveAll(joinDBRootPath)
+		w.joinDB, _ = InitDBAt(joinDBRootPath)
+		w.joinTree = UnMarshalTree(msg.MsgBytes)
+		log.Println("Finish updating join tree")
+	case "JoinDataBatch":
+		var databatch DataBatch
+		err = json.Unmarshal(msg.MsgBytes, &databatch)
+		if err != nil {
+			log.Println("Unable to unmarshal join databatch")
+		}
+		w.joinDB.Feed(&databatch)
 	case "Query":
 		q := UnMarshalQuery(msg.MsgBytes)
-		dataPoints, err := w.executeQuery(q)
+		if q.Explain != explainNone {
+			w.sendPlan(q)
+			return
+		}
+		if q.QueryType == 5 || q.QueryType == 6 || q.QueryType == 7 || q.QueryType == 8 || q.QueryType == 10 || q.QueryType == 11 {
+			w.sendAggregate(q)
+			return
+		}
+		if (q.QueryType == 1 || q.QueryType == 4) && q.PageSize > 0 {
+			w.sendPage(q)
+			return
+		}
+		if q.QueryType == 2 && (q.Epsilon > 0 || q.MaxCells > 0) {
+			w.sendApproxKNN(q)
+			return
+		}
+		dataPoints, err := w.executeCached(q)
 		if err != nil {
 			log.Println("No results found")
 			b, _ := json.Marshal(Message{Type: "Error"})
@@ -140,12 +186,102 @@ func (w *Worker) HandleClientRequests(client net.Conn) {
 		res, _ := json.Marshal(Message{Type: "DataPoints", MsgBytes: b})
 		//log.Printf("Sending results back to client.. Size:%d\n", len(b))
 		w.send(w.clientInfo.address.String(), res)
+	case "QueryBatch":
+		var qs []*Query
+		err = json.Unmarshal(msg.MsgBytes, &qs)
+		if err != nil {
+			log.Println("Unable to unmarshal query batch")
+		}
+		b, _ := json.Marshal(w.BatchQuery(qs))
+		res, _ := json.Marshal(Message{Type: "BatchResults", MsgBytes: b, SenderID: w.id})
+		w.send(w.clientInfo.address.String(), res)
+	case "CacheStats":
+		b, _ := json.Marshal(w.results.Statistics())
+		res, _ := json.Marshal(Message{Type: "CacheStats", MsgBytes: b, SenderID: w.id})
+		w.send(w.clientInfo.address.String(), res)
 
 	default:
 		log.Println("Unrecognized message")
 	}
 }
 
+// Send the partial aggregate, heatmap, OD trips, flow counts, top-N or join of the cubes on this worker back to client
+func (w *Worker) sendAggregate(q *Query) {
+	var agg interface{}
+	var err error
+	if q.QueryType == 5 && q.GroupBy != groupNone {
+		agg, err = w.GroupedAggregateQuery(q)
+	} else if q.QueryType == 5 {
+		agg, err = w.AggregateQuery(q)
+	} else if q.QueryType == 6 {
+		agg, err = w.HeatmapQuery(q)
+	} else if q.QueryType == 10 {
+		agg, err = w.TopNQuery(q)
+	} else if q.QueryType == 11 {
+		agg, err = w.JoinQuery(q, func(pairs []JoinPair) {
+			b, _ := json.Marshal(pairs)
+			res, _ := json.Marshal(Message{Type: "JoinPairs", MsgBytes: b, SenderID: w.id, QueryID: q.ID})
+			w.send(w.clientInfo.address.String(), res)
+		})
+	} else if q.QueryType == 7 {
+		agg, _, err = w.ODQuery(q)
+	} else {
+		_, agg, err = w.ODQuery(q)
+	}
+	if err != nil {
+		log.Println(err)
+		b, _ := json.Marshal(Message{Type: "Error", SenderID: w.id, QueryID: q.ID})
+		w.send(w.clientInfo.address.String(), b)
+		return
+	}
+	b, _ := json.Marshal(agg)
+	res, _ := json.Marshal(Message{Type: "Aggregate", MsgBytes: b, SenderID: w.id, QueryID: q.ID})
+	w.send(w.clientInfo.address.String(), res)
+}
+
+// Send the approximate KNN result back to client together with its error bound
+func (w *Worker) sendApproxKNN(q *Query) {
+	dataPoints, bound, err := w.ApproxKNNQuery(q)
+	if err != nil {
+		b, _ := json.Marshal(Message{Type: "Error", SenderID: w.id, QueryID: q.ID})
+		w.send(w.clientInfo.address.String(), b)
+		return
+	}
+	if math.IsInf(bound, 1) {
+		bound = -1
+	}
+	b, _ := json.Marshal(dataPoints)
+	res, _ := json.Marshal(Message{Type: "DataPoints", MsgBytes: b, SenderID: w.id, QueryID: q.ID, ErrorBound: bound})
+	w.send(w.clientInfo.address.String(), res)
+}
+
+// Send a page of the query back to client together with the cursor of the next page
+func (w *Worker) sendPage(q *Query) {
+	dataPoints, next, err := w.RegionPage(q)
+	if err != nil {
+		log.Println(err)
+		b, _ := json.Marshal(Message{Type: "Error", SenderID: w.id, QueryID: q.ID})
+		w.send(w.clientInfo.address.String(), b)
+		return
+	}
+	b, _ := json.Marshal(dataPoints)
+	res, _ := json.Marshal(Message{Type: "Page", MsgBytes: b, SenderID: w.id, QueryID: q.ID, Cursor: next})
+	w.send(w.clientInfo.address.String(), res)
+}
+
+// Send the plan of the query back to client, executed for ANALYZE
+func (w *Worker) sendPlan(q *Query) {
+	plan, err := w.ExplainQuery(q)
+	if err != nil {
+		b, _ := json.Marshal(Message{Type: "Error", SenderID: w.id, QueryID: q.ID})
+		w.send(w.clientInfo.address.String(), b)
+		return
+	}
+	b, _ := json.Marshal(plan)
+	res, _ := json.Marshal(Message{Type: "Plan", MsgBytes: b, SenderID: w.id, QueryID: q.ID})
+	w.send(w.clientInfo.address.String(), res)
+}
+
 func (w *Worker) getDataBatch(node *DTreeNode, nodeInd int, workerInd int) {
 	if node.IsLeaf {
 		w.cubeList[nodeInd] = workerInd + 2
@@ -227,7 +363,7 @@ func (w *Worker) PeerListener() {
 				//Read cube from db
 				var dp []DataPoint
 				for _, cubeInd := range cubeInds {
-					dPoints := w.db.ReadAll(cubeInd)
+					dPoints := w.db.ReadAllColumns(cubeInd, msg.Columns)
 					dp = append(dp, dPoints...)
 				}
 				log.Println("get data point")
@@ -266,11 +402,23 @@ func (w *Worker) executeQuery(q *Query) (dp []DataPoint, err error) {
 	case 1:
 		dp, _, err = w.RangeQuery(q)
 	case 2:
+		dp, err = w.KNNQuery(q)
+	case 3:
+		dp, _, err = w.RadiusQuery(q)
+	case 4:
+		dp, _, err = w.PolygonQuery(q)
+	case 7:
+		dp, _, err = w.ODQuery(q)
+	case 9:
+		dp, _, err = w.RNNQuery(q)
 	}
 	return
 }
 
 func (worker *Worker) EqualityQuery(query *Query) ([]DataPoint, int, error) {
+	if err := query.ValidatePredicate(); err != nil {
+		return nil, 0, err
+	}
 	cubeInds, err := worker.dTree.EquatlitySearch(query.QueryDims, query.QueryDimVals)
 	if err != nil {
 		return nil, 0, err
@@ -289,17 +437,16 @@ func (worker *Worker) EqualityQuery(query *Query) ([]DataPoint, int, error) {
 
 	var dataPoints []DataPoint
 	var conflictNum = 0
+	decodeDims := query.decodeDims()
 	for i, cubeInd := range cubeInds {
 
-		dPoints := worker.db.ReadSingle(cubeInd, metaInds[i])
+		dPoints := worker.db.ReadSingleColumns(cubeInd, metaInds[i], decodeDims)
 		//fmt.Println(fmt.Sprintf("CubeInd: %d, MetaInd %d", cubeInd, metaInds[i]))
 		//fmt.Println(dPoints)
 		for _, dp := range dPoints {
 			if query.CheckPoint(&dp) {
 				//fmt.Println("found")
-				for i:=0;i<100;i++{
-					dataPoints = append(dataPoints, dp)
-				}
+				dataPoints = append(dataPoints, query.Project(&dp))
 			}
 		}
 		conflictNum = len(dPoints) - len(dataPoints)
@@ -308,7 +455,7 @@ func (worker *Worker) EqualityQuery(query *Query) ([]DataPoint, int, error) {
 }
 
 func (worker *Worker) RangeQuery(query *Query) ([]DataPoint, int, error) {
-	cubeInds, err := worker.dTree.RangeSearch(query.QueryDims, query.QueryDimVals, query.QueryDimOpts)
+	cubeInds, err := worker.dTree.PredicateSearch(query.ToPredicate())
 	if err != nil {
 		return nil, 0, err
 	}
@@ -316,15 +463,31 @@ func (worker *Worker) RangeQuery(query *Query) ([]DataPoint, int, error) {
 	var dataPoints []DataPoint
 	totalDrawnNum := int(0)
 
-	dPoints := worker.getAll(cubeInds)
+	// read the cells overlapping the range on the cubes stored here, or scan whole cubes
+	// when the cells hold most of the points, see chooseRead
+	decodeDims := query.decodeDims()
+	var dPoints []DataPoint
+	var scanInds []int
+	for _, cubeInd := range cubeInds {
+		leaf, _ := worker.planLeaf(query, cubeInd)
+		if leaf.Read == readAll {
+			scanInds = append(scanInds, cubeInd)
+		} else {
+			dPoints = append(dPoints, worker.readLeaf(&leaf, decodeDims)...)
+		}
+	}
+	dPoints = append(dPoints, worker.getAll(scanInds, decodeDims)...)
 
 	//wait for results
 
 	//Check dpoints
 	for _, dp := range dPoints {
+		if query.Limit > 0 && len(dataPoints) == query.Limit {
+			break
+		}
 		if query.CheckPoint(&dp) {
 			//fmt.Println("found")
-			dataPoints = append(dataPoints, dp)
+			dataPoints = append(dataPoints, query.Project(&dp))
 		}
 	}
 	totalDrawnNum += len(dPoints)
@@ -332,22 +495,165 @@ func (worker *Worker) RangeQuery(query *Query) ([]DataPoint, int, error) {
 	return dataPoints, overDrawnNum, nil
 }
 
-func (w *Worker) getAll(cubeInds []int) []DataPoint {
+// Return the points within query.Radius of the query center, and the number of cells scanned
+func (worker *Worker) RadiusQuery(query *Query) ([]DataPoint, int, error) {
+	if err := query.ValidatePredicate(); err != nil {
+		return nil, 0, err
+	}
+	metric, err := query.DistanceMetric(worker.dTree.Dims)
+	if err != nil {
+		return nil, 0, err
+	}
+	centerData, err := query.ToDimFloatVal(worker.dTree)
+	if err != nil {
+		return nil, 0, err
+	}
+	cubeInds, err := worker.dTree.RadiusSearch(centerData, query.Radius, metric)
+	if err != nil {
+		return nil, 0, err
+	}
+	boxMins, boxMaxs := metric.BoundingBox(centerData, query.Radius)
+	decodeDims := query.decodeDims(worker.dTree.Dims)
+
+	var dPoints []DataPoint
+	var remoteInds []int
+	cellNum := 0
+	for _, cubeInd := range cubeInds {
+		node := &worker.dTree.Nodes[cubeInd]
+		lo, hi, overlap := node.GridRange(boxMins, boxMaxs)
+		if !overlap {
+			continue
+		}
+		// the MetaCube of a leaf owned by another worker is not stored here, read the whole leaf from its owner
+		if worker.cubeList[cubeInd] != worker.id {
+			remoteInds = append(remoteInds, cubeInd)
+			cellNum += int(node.Capacity)
+			continue
+		}
+		// prune the cells of the MetaCube outside the circle
+		var metaInds []int
+		for _, metaInd := range node.MetaIndsInGridRange(lo, hi) {
+			cellMins, cellMaxs, _ := node.Boundary(metaInd)
+			if metric.LowerBound(centerData, cellMins, cellMaxs) <= query.Radius {
+				metaInds = append(metaInds, metaInd)
+			}
+		}
+		if len(metaInds) == 0 {
+			continue
+		}
+		cellNum += len(metaInds)
+		dPoints = append(dPoints, worker.db.ReadBatchColumns(cubeInd, metaInds, decodeDims)...)
+	}
+	dPoints = append(dPoints, worker.getAll(remoteInds, decodeDims)...)
+
+	var dataPoints []DataPoint
+	for _, dp := range dPoints {
+		if metric.Distance(centerData, dp.getFloatValsByDims(worker.dTree.Dims)) <= query.Radius && query.CheckPredicate(&dp) {
+			dataPoints = append(dataPoints, query.Project(&dp))
+		}
+	}
+	return dataPoints, cellNum, nil
+}
+
+// Return the points inside query.Polygon, and the number of points drawn but rejected
+func (worker *Worker) PolygonQuery(query *Query) ([]DataPoint, int, error) {
+	if query.Polygon == nil || len(query.QueryDims) != 2 {
+		err := errors.New("Polygon query requires a polygon on 2 dims")
+		fmt.Println(err)
+		return nil, 0, err
+	}
+	if err := query.ValidatePredicate(); err != nil {
+		return nil, 0, err
+	}
+	xDim, yDim := query.QueryDims[0], query.QueryDims[1]
+	xInd, yInd, err := polygonDimInds(worker.dTree.Dims, xDim, yDim)
+	if err != nil {
+		return nil, 0, err
+	}
+	cubeInds, err := worker.dTree.PolygonSearch(query.Polygon, xDim, yDim)
+	if err != nil {
+		return nil, 0, err
+	}
+	boxMins := make([]float64, len(worker.dTree.Dims))
+	boxMaxs := make([]float64, len(worker.dTree.Dims))
+	for i := range boxMins {
+		boxMins[i], boxMaxs[i] = math.Inf(-1), math.Inf(1)
+	}
+	boxMins[xInd], boxMins[yInd], boxMaxs[xInd], boxMaxs[yInd] = query.Polygon.Bounds()
+	decodeDims := query.decodeDims()
+
+	var dataPoints []DataPoint
+	var remoteInds []int
+	overDrawnNum := 0
+	for _, cubeInd := range cubeInds {
+		node := &worker.dTree.Nodes[cubeInd]
+		lo, hi, overlap := node.GridRange(boxMins, boxMaxs)
+		if !overlap {
+			continue
+		}
+		// leaves owned by another worker are read whole from their owner and every point is tested
+		if worker.cubeList[cubeInd] != worker.id {
+			remoteInds = append(remoteInds, cubeInd)
+			continue
+		}
+		// only the cells crossed by the polygon edges need point tests
+		var insideInds, partialInds []int
+		for _, metaInd := range node.MetaIndsInGridRange(lo, hi) {
+			cellMins, cellMaxs, _ := node.Boundary(metaInd)
+			switch query.Polygon.BoxRelation(cellMins[xInd], cellMins[yInd], cellMaxs[xInd], cellMaxs[yInd]) {
+			case boxInside:
+				insideInds = append(insideInds, metaInd)
+			case boxPartial:
+				partialInds = append(partialInds, metaInd)
+			}
+		}
+		if len(insideInds) > 0 {
+			for _, dp := range worker.db.ReadBatchColumns(cubeInd, insideInds, decodeDims) {
+				if query.CheckPredicate(&dp) {
+					dataPoints = append(dataPoints, query.Project(&dp))
+				} else {
+					overDrawnNum++
+				}
+			}
+		}
+		if len(partialInds) > 0 {
+			for _, dp := range worker.db.ReadBatchColumns(cubeInd, partialInds, decodeDims) {
+				if query.Polygon.Contains(dp.getFloatValByDim(xDim), dp.getFloatValByDim(yDim)) && query.CheckPredicate(&dp) {
+					dataPoints = append(dataPoints, query.Project(&dp))
+				} else {
+					overDrawnNum++
+				}
+			}
+		}
+	}
+	for _, dp := range worker.getAll(remoteInds, decodeDims) {
+		if query.Polygon.Contains(dp.getFloatValByDim(xDim), dp.getFloatValByDim(yDim)) && query.CheckPredicate(&dp) {
+			dataPoints = append(dataPoints, query.Project(&dp))
+		} else {
+			overDrawnNum++
+		}
+	}
+	return dataPoints, overDrawnNum, nil
+}
+
+// Read the cubes from their owners decoding only the given dims, nil for every dim
+func (w *Worker) getAll(cubeInds []int, dims []uint) []DataPoint {
 	m := make(map[int][]int)
 	for _, cubeInd := range cubeInds {
 		m[w.cubeList[cubeInd]] = append(m[w.cubeList[cubeInd]], cubeInd)
 	}
 
 	var dPoints []DataPoint
+	var mu sync.Mutex
 	var wg sync.WaitGroup
-	nbGoroutines := len(m)
-	wg.Add(nbGoroutines)
-	go func() {
-		for wid, v := range m {
+	wg.Add(len(m))
+	for wid, v := range m {
+		go func(wid int, v []int) {
+			defer wg.Done()
+			var temp []DataPoint
 			if wid == w.id {
 				for _, cubeInd := range v {
-					temp := w.db.ReadAll(cubeInd)
-					dPoints = append(dPoints, temp...)
+					temp = append(temp, w.db.ReadAllColumns(cubeInd, dims)...)
 				}
 			} else {
 				dest := w.peerList[wid].udpaddr
@@ -358,7 +664,7 @@ func (w *Worker) getAll(cubeInds []int) []DataPoint {
 					conn, err := net.DialUDP("udp", &src, &dest)
 					log.Println("Sending udp packet")
 					if err == nil {
-						msg, _ := json.Marshal(Message{Type: "PeerRequestAll", CubeIndex: v, SenderID: w.id})
+						msg, _ := json.Marshal(Message{Type: "PeerRequestAll", CubeIndex: v, SenderID: w.id, Columns: dims})
 						conn.Write(msg)
 						conn.Close()
 						break
@@ -367,13 +673,13 @@ func (w *Worker) getAll(cubeInds []int) []DataPoint {
 
 				log.Println("Wait here")
 				dpbuf := <-w.peerChan
-				var dp []DataPoint
-				json.Unmarshal(dpbuf, &dp)
-				dPoints = append(dPoints, dp...)
+				json.Unmarshal(dpbuf, &temp)
 			}
-		}
-		wg.Done()
-		log.Println("Done one")
-	}()
+			mu.Lock()
+			dPoints = append(dPoints, temp...)
+			mu.Unlock()
+		}(wid, v)
+	}
+	wg.Wait()
 	return dPoints
 }